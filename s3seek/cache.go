@@ -0,0 +1,247 @@
+package s3seek
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// DefaultBlockSize is the block size of a Cache if none is given.
+const DefaultBlockSize = 1 << 20
+
+// Cache is an LRU cache of fixed-size, aligned blocks of objects. It is safe
+// for concurrent use and may be shared by readers of different objects.
+type Cache struct {
+	blockSize int64
+	max       int64
+
+	mu     sync.Mutex
+	used   int64
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+	// blocks being fetched.
+	flights map[blockKey]*flight
+
+	// disk, if not nil, stores the blocks under the blocks in memory.
+	disk *diskCache
+}
+
+// objectKey identifies an object in a Cache.
+type objectKey struct {
+	// id is the url of the object, e.g. s3://bucket/key.
+	id string
+	// etag is empty if it is not known.
+	etag string
+}
+
+type blockKey struct {
+	obj objectKey
+	i   int64
+}
+
+type block struct {
+	key  blockKey
+	data []byte
+}
+
+// fetchFunc fills p with the bytes of an object from off.
+type fetchFunc func(ctx context.Context, off int64, p []byte) error
+
+// NewCache returns a Cache of blocks of blockSize bytes (DefaultBlockSize if
+// 0) that holds at most size bytes.
+func NewCache(blockSize int, size int64) *Cache {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &Cache{blockSize: int64(blockSize), max: size, lru: list.New(), blocks: make(map[blockKey]*list.Element),
+		flights: make(map[blockKey]*flight)}
+}
+
+// BlockSize returns the size of the blocks in the cache.
+func (c *Cache) BlockSize() int {
+	return int(c.blockSize)
+}
+
+func (c *Cache) get(k blockKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[k]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*block).data
+}
+
+// has returns whether the block is cached without marking it as used.
+func (c *Cache) has(k blockKey) bool {
+	c.mu.Lock()
+	_, ok := c.blocks[k]
+	c.mu.Unlock()
+	return ok || c.disk != nil && c.disk.has(k)
+}
+
+// load returns the block of an object of size bytes from memory or else
+// from disk.
+func (c *Cache) load(k blockKey, size int64) []byte {
+	if b := c.get(k); b != nil || c.disk == nil {
+		return b
+	}
+	start, end := c.span(k.i, size)
+	b := c.disk.get(k, end-start)
+	if b != nil {
+		c.add(k, b)
+	}
+	return b
+}
+
+// put adds a fetched block to memory and to disk.
+func (c *Cache) put(k blockKey, data []byte) {
+	c.add(k, data)
+	if c.disk != nil {
+		c.disk.add(k, data)
+	}
+}
+
+func (c *Cache) add(k blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[k]; ok || int64(len(data)) > c.max {
+		return
+	}
+	c.blocks[k] = c.lru.PushFront(&block{key: k, data: data})
+	c.used += int64(len(data))
+	for c.used > c.max {
+		b := c.lru.Remove(c.lru.Back()).(*block)
+		delete(c.blocks, b.key)
+		c.used -= int64(len(b.data))
+	}
+}
+
+// flight is a fetch of a block that other readers can wait for. data and err
+// are set before done is closed.
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// claim returns the block if it is in memory. Otherwise it returns the
+// flight for the block and whether the caller owns it, in which case the
+// caller must fetch the block and call land.
+func (c *Cache) claim(k blockKey) (data []byte, f *flight, own bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[k]; ok {
+		return e.Value.(*block).data, nil, false
+	}
+	if f, ok := c.flights[k]; ok {
+		return nil, f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.flights[k] = f
+	return nil, f, true
+}
+
+// land caches a fetched block (if err is nil) and wakes the readers waiting
+// for its flight.
+func (c *Cache) land(k blockKey, f *flight, data []byte, err error) {
+	if err == nil {
+		c.put(k, data)
+	}
+	c.mu.Lock()
+	delete(c.flights, k)
+	c.mu.Unlock()
+	f.data, f.err = data, err
+	close(f.done)
+}
+
+// span returns the range of block i in an object of size bytes.
+func (c *Cache) span(i, size int64) (start, end int64) {
+	start, end = i*c.blockSize, (i+1)*c.blockSize
+	if end > size {
+		end = size
+	}
+	return start, end
+}
+
+// readAt fills p with the bytes of the object obj (of size bytes) from off
+// using the cached blocks. Runs of adjacent blocks that are not cached are
+// requested with a single fetch. A block that another reader is fetching is
+// waited for rather than fetched again. off+len(p) must not be past size.
+func (c *Cache) readAt(ctx context.Context, fetch fetchFunc, obj objectKey, size int64, p []byte, off int64) error {
+	if len(p) == 0 {
+		return nil
+	}
+	first, last := off/c.blockSize, (off+int64(len(p))-1)/c.blockSize
+	// the blocks are kept here as they may be evicted before they are copied.
+	data := make([][]byte, last-first+1)
+	flights := make([]*flight, len(data))
+	owned := make([]bool, len(data))
+	for i := range data {
+		k := blockKey{obj, first + int64(i)}
+		if data[i] = c.load(k, size); data[i] == nil {
+			data[i], flights[i], owned[i] = c.claim(k)
+		}
+	}
+	for i := 0; i < len(data); i++ {
+		if !owned[i] {
+			continue
+		}
+		j := i
+		for j < len(data)-1 && owned[j+1] {
+			j++
+		}
+		start, _ := c.span(first+int64(i), size)
+		_, end := c.span(first+int64(j), size)
+		buf := make([]byte, end-start)
+		if err := fetch(ctx, start, buf); err != nil {
+			// release this and all later flights.
+			for k := i; k < len(data); k++ {
+				if owned[k] {
+					c.land(blockKey{obj, first + int64(k)}, flights[k], nil, err)
+				}
+			}
+			return err
+		}
+		for k := i; k <= j; k++ {
+			b := buf[int64(k-i)*c.blockSize:]
+			if int64(len(b)) > c.blockSize {
+				b = b[:c.blockSize]
+			}
+			// copy so that each block can be freed when it is evicted.
+			b = append([]byte(nil), b...)
+			data[k] = b
+			c.land(blockKey{obj, first + int64(k)}, flights[k], b, nil)
+		}
+		i = j
+	}
+	for i, f := range flights {
+		if f == nil || owned[i] {
+			continue
+		}
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if data[i] = f.data; f.err == nil {
+			continue
+		}
+		// the other fetch may have been cancelled so try again.
+		start, end := c.span(first+int64(i), size)
+		data[i] = make([]byte, end-start)
+		if err := fetch(ctx, start, data[i]); err != nil {
+			return err
+		}
+		c.put(blockKey{obj, first + int64(i)}, data[i])
+	}
+	n := 0
+	for i, b := range data {
+		if i == 0 {
+			b = b[off-first*c.blockSize:]
+		}
+		n += copy(p[n:], b)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package s3seek
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fetcher serves ranges of data and records the requests.
+type fetcher struct {
+	data []byte
+	reqs [][2]int64
+}
+
+func (f *fetcher) fetch(ctx context.Context, off int64, p []byte) error {
+	f.reqs = append(f.reqs, [2]int64{off, off + int64(len(p))})
+	copy(p, f.data[off:])
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	f := &fetcher{data: make([]byte, 1000)}
+	rand.Read(f.data)
+	c := NewCache(100, 300)
+	size := int64(len(f.data))
+
+	p := make([]byte, 150)
+	if err := c.readAt(context.Background(), f.fetch, objectKey{id: "a"}, size, p, 50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, f.data[50:200]) {
+		t.Fatal("wrong data")
+	}
+	// blocks 0 and 1 in one request.
+	if len(f.reqs) != 1 || f.reqs[0] != [2]int64{0, 200} {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+
+	// block 1 is cached so only 2 and 3 are requested.
+	f.reqs = nil
+	p = make([]byte, 250)
+	if err := c.readAt(context.Background(), f.fetch, objectKey{id: "a"}, size, p, 150); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, f.data[150:400]) {
+		t.Fatal("wrong data")
+	}
+	if len(f.reqs) != 1 || f.reqs[0] != [2]int64{200, 400} {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+
+	// block 0 was evicted; 1 was used more recently.
+	if c.get(blockKey{objectKey{id: "a"}, 0}) != nil || c.get(blockKey{objectKey{id: "a"}, 1}) == nil {
+		t.Error("expected block 0 to be evicted")
+	}
+
+	// the last block is short and other objects are separate.
+	f.reqs = nil
+	p = make([]byte, 10)
+	if err := c.readAt(context.Background(), f.fetch, objectKey{id: "b"}, 950, p, 940); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.reqs) != 1 || f.reqs[0] != [2]int64{900, 950} || len(c.get(blockKey{objectKey{id: "b"}, 9})) != 50 {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	data := make([]byte, 200)
+	rand.Read(data)
+	c := NewCache(100, 1000)
+	var mu sync.Mutex
+	var reqs int
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context, off int64, p []byte) error {
+		mu.Lock()
+		reqs++
+		mu.Unlock()
+		close(started)
+		<-release
+		copy(p, data[off:])
+		return nil
+	}
+	errs := make(chan error, 2)
+	read := func() {
+		p := make([]byte, 50)
+		err := c.readAt(context.Background(), fetch, objectKey{id: "a"}, 200, p, 20)
+		if err == nil && !bytes.Equal(p, data[20:70]) {
+			err = errors.New("wrong data")
+		}
+		errs <- err
+	}
+	go read()
+	<-started
+	// the second reader waits for the block that the first is fetching.
+	go read()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reqs != 1 {
+		t.Fatalf("expected 1 request, got %d", reqs)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := &fetcher{data: make([]byte, 1000)}
+	rand.Read(f.data)
+	size := int64(len(f.data))
+	v1 := objectKey{id: "s3://bucket/key", etag: `"v1"`}
+	ctx := context.Background()
+
+	c, err := NewDiskCache(dir, 100, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.disk.wg.Wait()
+	p := make([]byte, 300)
+	if err := c.readAt(ctx, f.fetch, v1, size, p, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// another cache, as in another process, reads the blocks from disk.
+	f.reqs = nil
+	c2, _ := NewDiskCache(dir, 100, 0, 1000)
+	c2.disk.wg.Wait()
+	if err := c2.readAt(ctx, f.fetch, v1, size, p, 50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, f.data[50:350]) {
+		t.Fatal("wrong data")
+	}
+	if len(f.reqs) != 1 || f.reqs[0] != [2]int64{300, 400} {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+
+	// a block with the wrong length is fetched again.
+	f.reqs = nil
+	ioutil.WriteFile(c2.disk.path(blockKey{v1, 2}), f.data[200:250], 0644)
+	c3, _ := NewDiskCache(dir, 100, 0, 1000)
+	c3.disk.wg.Wait()
+	if err := c3.readAt(ctx, f.fetch, v1, size, p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, f.data[:300]) || len(f.reqs) != 1 || f.reqs[0] != [2]int64{200, 300} {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+
+	// the blocks of another ETag are not used, but are kept while another
+	// process may be reading them.
+	f.reqs = nil
+	v2 := objectKey{id: v1.id, etag: `"v2"`}
+	if err := c3.readAt(ctx, f.fetch, v2, size, p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.reqs) != 1 || !c3.disk.has(blockKey{v1, 1}) || !c3.disk.has(blockKey{v2, 1}) {
+		t.Fatalf("unexpected requests: %v", f.reqs)
+	}
+	// they are removed once they are not used for staleAge.
+	old := time.Now().Add(-2 * staleAge)
+	os.Chtimes(filepath.Dir(c2.disk.path(blockKey{v1, 1})), old, old)
+	if err := c2.readAt(ctx, f.fetch, v2, size, p, 300); err != nil {
+		t.Fatal(err)
+	}
+	if c2.disk.has(blockKey{v1, 1}) || !c2.disk.has(blockKey{v2, 4}) {
+		t.Error("expected the blocks of the old ETag to be removed")
+	}
+	if fis, _ := ioutil.ReadDir(filepath.Dir(filepath.Dir(c2.disk.path(blockKey{v2, 1})))); len(fis) != 1 {
+		t.Errorf("expected only the directory of the current ETag, got %d", len(fis))
+	}
+
+	// a cache that can't use the usage of the last walk walks dir and
+	// evicts the least recently used blocks to stay under 500 bytes.
+	os.Remove(filepath.Join(dir, usageFile))
+	os.Chtimes(c2.disk.path(blockKey{v2, 0}), old, old)
+	c4, _ := NewDiskCache(dir, 100, 0, 500)
+	c4.disk.wg.Wait()
+	if c4.disk.has(blockKey{v2, 0}) || !c4.disk.has(blockKey{v2, 5}) {
+		t.Error("expected block 0 to be evicted")
+	}
+	if c4.disk.used > 500 {
+		t.Errorf("expected at most 500 bytes on disk, got %d", c4.disk.used)
+	}
+	// blocks added beyond the limit are evicted in the background.
+	if err := c4.readAt(ctx, f.fetch, v2, size, p, 600); err != nil {
+		t.Fatal(err)
+	}
+	c4.disk.wg.Wait()
+	if !c4.disk.has(blockKey{v2, 8}) || c4.disk.used > 500 {
+		t.Errorf("expected at most 500 bytes on disk, got %d", c4.disk.used)
+	}
+	// the next cache uses the usage from that walk.
+	c5, _ := NewDiskCache(dir, 100, 0, 500)
+	if c5.disk.evicting || c5.disk.used != c4.disk.used {
+		t.Errorf("expected the usage of the last walk (%d), got %d", c4.disk.used, c5.disk.used)
+	}
+
+	// objects without an ETag are not stored.
+	c4.readAt(ctx, f.fetch, objectKey{id: "a"}, size, p, 0)
+	if c4.disk.has(blockKey{objectKey{id: "a"}, 0}) {
+		t.Error("expected no blocks without an ETag")
+	}
+}
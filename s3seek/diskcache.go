@@ -0,0 +1,289 @@
+package s3seek
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewDiskCache returns a Cache as for NewCache that also stores its blocks in
+// files under dir, keeping at most diskSize bytes there with the least
+// recently used files removed first. Blocks are keyed by the bucket and key
+// (or url) and the ETag of their object so that blocks of a changed object
+// are never used; objects without an ETag are not stored. Files are written
+// with atomic renames so any number of processes may share dir. Files are
+// removed in the background.
+func NewDiskCache(dir string, blockSize int, size, diskSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := NewCache(blockSize, size)
+	c.disk = &diskCache{dir: dir, max: diskSize, blockSize: c.blockSize, checked: make(map[objectKey]bool)}
+	// dir is only walked if no process has done so recently.
+	if !c.disk.readUsage() {
+		c.disk.startEvict()
+	}
+	return c, nil
+}
+
+// tmpPrefix starts the names of files that are being written.
+const tmpPrefix = ".tmp-"
+
+// usageFile holds the size of the files in dir at the last walk so that
+// each process does not need to walk dir.
+const usageFile = ".usage"
+
+// usageAge is how old the usageFile may be before dir is walked again.
+const usageAge = 10 * time.Minute
+
+// staleAge is how long the blocks of another ETag of an object, or a temp
+// file, must be unused before they are removed. Another process may still
+// be reading that version of the object.
+const staleAge = time.Hour
+
+// diskCache stores blocks in files at dir/hash(id)/hash(etag)/blockSize.i.
+// The modification time of a file (and its directory) is updated when it is
+// read so that it gives the LRU order for all processes.
+type diskCache struct {
+	dir       string
+	max       int64
+	blockSize int64
+
+	mu sync.Mutex
+	// used is the size of the files at the last walk of dir plus the
+	// blocks added since.
+	used int64
+	// checked holds the objects whose stale ETags were removed.
+	checked map[objectKey]bool
+	// evicting is set while evict runs in the background.
+	evicting bool
+	wg       sync.WaitGroup
+}
+
+func hash(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:16])
+}
+
+func (d *diskCache) path(k blockKey) string {
+	return filepath.Join(d.dir, hash(k.obj.id), hash(k.obj.etag), fmt.Sprintf("%d.%d", d.blockSize, k.i))
+}
+
+// get returns the block, which must be n bytes, or nil if it is not stored.
+func (d *diskCache) get(k blockKey, n int64) []byte {
+	if k.obj.etag == "" {
+		return nil
+	}
+	p := d.path(k)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	if int64(len(data)) != n {
+		os.Remove(p)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	os.Chtimes(filepath.Dir(p), now, now)
+	return data
+}
+
+func (d *diskCache) has(k blockKey) bool {
+	if k.obj.etag == "" {
+		return false
+	}
+	_, err := os.Stat(d.path(k))
+	return err == nil
+}
+
+// add stores the block. Errors are ignored as the block is fetched again if
+// it is not stored.
+func (d *diskCache) add(k blockKey, data []byte) {
+	if k.obj.etag == "" || int64(len(data)) > d.max {
+		return
+	}
+	p := d.path(k)
+	d.removeStale(k.obj, filepath.Dir(p))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), tmpPrefix)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	d.mu.Lock()
+	d.used += int64(len(data))
+	if d.used > d.max {
+		d.startEvict()
+	}
+	d.mu.Unlock()
+}
+
+// readUsage sets used from the usageFile and reports whether it is recent.
+func (d *diskCache) readUsage() bool {
+	p := filepath.Join(d.dir, usageFile)
+	fi, err := os.Stat(p)
+	if err != nil || time.Since(fi.ModTime()) > usageAge {
+		return false
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	used, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return false
+	}
+	d.used = used
+	return true
+}
+
+// writeUsage replaces the usageFile. Errors are ignored as the next process
+// walks dir if it is missing.
+func (d *diskCache) writeUsage(used int64) {
+	f, err := ioutil.TempFile(d.dir, tmpPrefix)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(f, "%d\n", used)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(d.dir, usageFile))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// startEvict runs evict in the background unless it is already running.
+// must be called with d.mu held.
+func (d *diskCache) startEvict() {
+	if d.evicting {
+		return
+	}
+	d.evicting = true
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.evict()
+	}()
+}
+
+// removeStale removes the blocks of other ETags of the object that have not
+// been used for staleAge, once per process. Each directory is renamed before
+// it is removed so that other processes never see it partly removed.
+func (d *diskCache) removeStale(obj objectKey, dir string) {
+	d.mu.Lock()
+	checked := d.checked[obj]
+	d.checked[obj] = true
+	d.mu.Unlock()
+	if checked {
+		return
+	}
+	parent, cur := filepath.Dir(dir), filepath.Base(dir)
+	fis, err := ioutil.ReadDir(parent)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("s3seek: error removing stale cache blocks: %s", err)
+	}
+	for _, fi := range fis {
+		if fi.Name() == cur || strings.HasPrefix(fi.Name(), tmpPrefix) || time.Since(fi.ModTime()) < staleAge {
+			continue
+		}
+		tmp := filepath.Join(parent, tmpPrefix+fi.Name()+"."+strconv.Itoa(os.Getpid()))
+		if err := os.Rename(filepath.Join(parent, fi.Name()), tmp); err != nil {
+			// another process may have removed it.
+			if !os.IsNotExist(err) {
+				log.Printf("s3seek: error removing stale cache blocks: %s", err)
+			}
+			continue
+		}
+		if err := os.RemoveAll(tmp); err != nil {
+			log.Printf("s3seek: error removing stale cache blocks: %s", err)
+		}
+	}
+}
+
+// evict walks dir and removes the least recently used files until they are
+// under 90% of max so that it is not needed on every add. Files and stale
+// directories left by processes that died are also removed. The total is
+// written to the usageFile for other processes. d.mu is not held during the
+// walk; the caller must set d.evicting, which evict clears.
+func (d *diskCache) evict() {
+	// other processes that start now don't need to walk too.
+	now := time.Now()
+	os.Chtimes(filepath.Join(d.dir, usageFile), now, now)
+
+	type file struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []file
+	var total int64
+	filepath.Walk(d.dir, func(path string, fi os.FileInfo, err error) error {
+		// other processes may remove files during the walk.
+		if err != nil {
+			return nil
+		}
+		if fi.Name() == usageFile {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), tmpPrefix) {
+			if time.Since(fi.ModTime()) > staleAge {
+				os.RemoveAll(path)
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		files = append(files, file{path, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+	if total > d.max {
+		sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+		for _, f := range files {
+			if total <= d.max/10*9 {
+				break
+			}
+			if os.Remove(f.path) == nil {
+				total -= f.size
+				// remove the directories of the object if they are empty.
+				if os.Remove(filepath.Dir(f.path)) == nil {
+					os.Remove(filepath.Dir(filepath.Dir(f.path)))
+				}
+			}
+		}
+	}
+	d.writeUsage(total)
+	d.mu.Lock()
+	d.used, d.evicting = total, false
+	d.mu.Unlock()
+}
@@ -0,0 +1,335 @@
+// Package fakes3 is an in-memory S3 for testing code that uses s3seek. It
+// supports ranged GETs, ETags with IfMatch, multipart uploads and injected
+// errors.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrReset is the error from the Read of a body that was cut (see Cut).
+var ErrReset = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+// S3 is an in-memory S3. It is safe for concurrent use.
+type S3 struct {
+	// MinPartSize is the smallest part, except for the last, accepted by
+	// CompleteMultipartUploadWithContext. New sets it to 5 MiB as for S3.
+	MinPartSize int
+
+	mu      sync.Mutex
+	objects map[string]*object
+	uploads map[string]*upload
+	nextID  int
+	// injected errors by operation.
+	fails map[string][]error
+	// number of bytes after which to cut the next GetObject bodies.
+	cuts     []int64
+	requests map[string]int
+}
+
+type object struct {
+	data []byte
+	etag string
+}
+
+type upload struct {
+	bucket, key string
+	parts       map[int64][]byte
+}
+
+// New returns an empty S3.
+func New() *S3 {
+	return &S3{MinPartSize: 5 << 20, objects: make(map[string]*object), uploads: make(map[string]*upload),
+		fails: make(map[string][]error), requests: make(map[string]int)}
+}
+
+func etag(b []byte) string {
+	s := md5.Sum(b)
+	return `"` + hex.EncodeToString(s[:]) + `"`
+}
+
+func path(bucket, key *string) string {
+	return aws.StringValue(bucket) + "/" + aws.StringValue(key)
+}
+
+// Put sets the data of an object and returns its ETag.
+func (f *S3) Put(bucket, key string, data []byte) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := &object{data: append([]byte(nil), data...), etag: etag(data)}
+	f.objects[bucket+"/"+key] = o
+	return o.etag
+}
+
+// Object returns the data of an object.
+func (f *S3) Object(bucket, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Uploads returns the number of multipart uploads that were not completed
+// or aborted.
+func (f *S3) Uploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+// Requests returns the number of requests for an operation, e.g. "GetObject".
+func (f *S3) Requests(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[op]
+}
+
+// Fail makes the next request for the operation (e.g. "GetObject") fail
+// with err. Calls are queued so Fail can be called several times.
+func (f *S3) Fail(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fails[op] = append(f.fails[op], err)
+}
+
+// Cut makes the Read of the body of the next GetObject fail with ErrReset
+// after n bytes. Calls are queued as for Fail.
+func (f *S3) Cut(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cuts = append(f.cuts, n)
+}
+
+// ServerError returns an error like that of S3 for an internal error.
+func ServerError() error {
+	return awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error. Please try again.", nil), 500, "fake")
+}
+
+func requestFailure(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "fake")
+}
+
+// start a request and return the injected error, if any.
+// must be called in a lock.
+func (f *S3) start(ctx aws.Context, op string) error {
+	f.requests[op]++
+	if ctx != nil && ctx.Err() != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	if errs := f.fails[op]; len(errs) != 0 {
+		f.fails[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// parseRange returns the start and end (exclusive) of a Range header for an
+// object of size bytes. ok is false if the range can't be satisfied.
+func parseRange(r string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(r, "bytes=") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(r[6:], "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	if parts[0] == "" {
+		// the last n bytes.
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size
+	if parts[1] != "" {
+		e, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		if e+1 < end {
+			end = e + 1
+		}
+	}
+	return start, end, true
+}
+
+// GetObjectWithContext implements s3seek.Client.
+func (f *S3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "GetObject"); err != nil {
+		return nil, err
+	}
+	o, ok := f.objects[path(in.Bucket, in.Key)]
+	if !ok {
+		return nil, requestFailure(s3.ErrCodeNoSuchKey, 404)
+	}
+	if in.IfMatch != nil && *in.IfMatch != o.etag {
+		return nil, requestFailure("PreconditionFailed", 412)
+	}
+	size := int64(len(o.data))
+	out := &s3.GetObjectOutput{ETag: aws.String(o.etag)}
+	start, end := int64(0), size
+	if in.Range != nil {
+		if start, end, ok = parseRange(*in.Range, size); !ok {
+			return nil, requestFailure("InvalidRange", 416)
+		}
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+	out.ContentLength = aws.Int64(end - start)
+	var body io.Reader = bytes.NewReader(o.data[start:end])
+	if len(f.cuts) != 0 {
+		body = &cut{r: body, n: f.cuts[0]}
+		f.cuts = f.cuts[1:]
+	}
+	out.Body = ioutil.NopCloser(body)
+	return out, nil
+}
+
+// cut is a reader that fails after n bytes.
+type cut struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cut) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, ErrReset
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+// HeadObjectWithContext implements s3seek.Client.
+func (f *S3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "HeadObject"); err != nil {
+		return nil, err
+	}
+	o, ok := f.objects[path(in.Bucket, in.Key)]
+	if !ok {
+		return nil, requestFailure("NotFound", 404)
+	}
+	if in.IfMatch != nil && *in.IfMatch != o.etag {
+		return nil, requestFailure("PreconditionFailed", 412)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(o.data))), ETag: aws.String(o.etag)}, nil
+}
+
+// CreateMultipartUploadWithContext implements s3seek.Client.
+func (f *S3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = &upload{bucket: aws.StringValue(in.Bucket), key: aws.StringValue(in.Key), parts: make(map[int64][]byte)}
+	return &s3.CreateMultipartUploadOutput{Bucket: in.Bucket, Key: in.Key, UploadId: aws.String(id)}, nil
+}
+
+// UploadPartWithContext implements s3seek.Client.
+func (f *S3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "UploadPart"); err != nil {
+		return nil, err
+	}
+	u, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		return nil, requestFailure("NoSuchUpload", 404)
+	}
+	u.parts[aws.Int64Value(in.PartNumber)] = b
+	return &s3.UploadPartOutput{ETag: aws.String(etag(b))}, nil
+}
+
+// CompleteMultipartUploadWithContext implements s3seek.Client. Parts must be
+// in order and have the ETags from UploadPart. As with S3, all parts but the
+// last must be at least MinPartSize.
+func (f *S3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(in.UploadId)
+	u, ok := f.uploads[id]
+	if !ok {
+		return nil, requestFailure("NoSuchUpload", 404)
+	}
+	if in.MultipartUpload == nil || len(in.MultipartUpload.Parts) == 0 {
+		return nil, requestFailure("MalformedXML", 400)
+	}
+	parts := in.MultipartUpload.Parts
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber }) {
+		return nil, requestFailure("InvalidPartOrder", 400)
+	}
+	var data []byte
+	for i, p := range parts {
+		b, ok := u.parts[aws.Int64Value(p.PartNumber)]
+		if !ok || aws.StringValue(p.ETag) != etag(b) {
+			return nil, requestFailure("InvalidPart", 400)
+		}
+		if i != len(parts)-1 && len(b) < f.MinPartSize {
+			return nil, requestFailure("EntityTooSmall", 400)
+		}
+		data = append(data, b...)
+	}
+	delete(f.uploads, id)
+	o := &object{data: data, etag: fmt.Sprintf(`"%x-%d"`, md5.Sum(data), len(parts))}
+	f.objects[u.bucket+"/"+u.key] = o
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(o.etag)}, nil
+}
+
+// AbortMultipartUploadWithContext implements s3seek.Client.
+func (f *S3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start(ctx, "AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(in.UploadId)
+	if _, ok := f.uploads[id]; !ok {
+		return nil, requestFailure("NoSuchUpload", 404)
+	}
+	delete(f.uploads, id)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
@@ -0,0 +1,201 @@
+package s3seek
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// httpError is the error for an unexpected status from an HTTP server.
+type httpError struct {
+	status int
+	url    string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("s3seek: unexpected status %d %s for %s", e.status, http.StatusText(e.status), e.url)
+}
+
+// httpObject is the backend for a file on an HTTP server that supports range
+// requests.
+type httpObject struct {
+	c   *http.Client
+	url string
+}
+
+// NewHTTP returns a io.ReadSeeker for the file at url on an HTTP(S) server
+// that supports range requests. It returns an error if a request for the
+// first byte of the file does not get a partial response. Requests are made
+// with c or http.DefaultClient if c is nil. opts may be nil.
+func NewHTTP(c *http.Client, url string, opts *Options) (ReadSeekCloser, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("s3seek: expected an http(s) url. got %s", url)
+	}
+	if c == nil {
+		c = http.DefaultClient
+	}
+	o := &httpObject{c: c, url: url}
+	if err := o.checkRanges(); err != nil {
+		return nil, err
+	}
+	return newReader(o, opts), nil
+}
+
+// checkRanges returns an error if the server does not support range requests
+// for the url.
+func (o *httpObject) checkRanges() error {
+	resp, err := o.do(context.Background(), http.MethodGet, http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// 416 is a response for an empty file.
+		return nil
+	case http.StatusOK:
+		if resp.ContentLength == 0 {
+			return nil
+		}
+		return fmt.Errorf("s3seek: server does not support range requests for %s", o.url)
+	}
+	return &httpError{status: resp.StatusCode, url: o.url}
+}
+
+func (o *httpObject) do(ctx context.Context, method string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, o.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return o.c.Do(req.WithContext(ctx))
+}
+
+// etag returns the ETag of resp or "" for a weak ETag which can not be used
+// with If-Match.
+func etag(resp *http.Response) string {
+	e := resp.Header.Get("ETag")
+	if strings.HasPrefix(e, "W/") {
+		return ""
+	}
+	return e
+}
+
+func matchHeader(ifMatch string) http.Header {
+	h := http.Header{}
+	if ifMatch != "" {
+		h.Set("If-Match", ifMatch)
+	}
+	return h
+}
+
+func (o *httpObject) head(ctx context.Context, ifMatch string) (int64, string, error) {
+	resp, err := o.do(ctx, http.MethodHead, matchHeader(ifMatch))
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return 0, "", ErrChanged
+	default:
+		return 0, "", &httpError{status: resp.StatusCode, url: o.url}
+	}
+	if resp.ContentLength < 0 {
+		return 0, "", fmt.Errorf("s3seek: no Content-Length for %s", o.url)
+	}
+	return resp.ContentLength, etag(resp), nil
+}
+
+func (o *httpObject) get(ctx context.Context, off, end int64, ifMatch string) (io.ReadCloser, int64, string, error) {
+	h := matchHeader(ifMatch)
+	if end == -1 {
+		h.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	} else {
+		h.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
+	}
+	resp, err := o.do(ctx, http.MethodGet, h)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, contentRangeSize(resp.Header.Get("Content-Range")), etag(resp), nil
+	case http.StatusOK:
+		// the server ignored the Range which is only usable from the start.
+		if off != 0 {
+			resp.Body.Close()
+			return nil, 0, "", fmt.Errorf("s3seek: server does not support range requests for %s", o.url)
+		}
+		var body io.ReadCloser = resp.Body
+		if end != -1 {
+			body = struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, end+1), resp.Body}
+		}
+		return body, resp.ContentLength, etag(resp), nil
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, 0, "", errInvalidRange
+	case http.StatusPreconditionFailed:
+		return nil, 0, "", ErrChanged
+	}
+	return nil, 0, "", &httpError{status: resp.StatusCode, url: o.url}
+}
+
+func (o *httpObject) id() string { return o.url }
+
+// Open returns a io.ReadSeeker for rawurl with the backend for its scheme:
+// s3:// uses New with opts.S3 or, if it is nil, a client from the default
+// session; http:// and https:// use NewHTTP with opts.HTTPClient; file:// and
+// paths without a scheme open a local file for which opts are not used. opts
+// may be nil.
+func Open(rawurl string, opts *Options) (ReadSeekCloser, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	switch {
+	case strings.HasPrefix(rawurl, "s3://"):
+		c := opts.S3
+		if c == nil {
+			sess, err := session.NewSession()
+			if err != nil {
+				return nil, errors.Wrap(err, "error creating aws session")
+			}
+			c = s3.New(sess)
+		}
+		return NewWithOptions(c, rawurl, nil, opts)
+	case strings.HasPrefix(rawurl, "http://"), strings.HasPrefix(rawurl, "https://"):
+		return NewHTTP(opts.HTTPClient, rawurl, opts)
+	case strings.HasPrefix(rawurl, "file://"):
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		// file://dir/f would otherwise open /f.
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("s3seek: file url must have an absolute path and no host. got %s", rawurl)
+		}
+		return os.Open(u.Path)
+	case strings.Contains(rawurl, "://"):
+		return nil, fmt.Errorf("s3seek: unsupported scheme in %s", rawurl)
+	}
+	return os.Open(rawurl)
+}
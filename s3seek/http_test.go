@@ -0,0 +1,132 @@
+package s3seek_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+func serve(data []byte, etag *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", *etag)
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func TestHTTP(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.Read(data)
+	etag := `"v1"`
+	srv := serve(data, &etag)
+	defer srv.Close()
+
+	s, err := s3seek.NewHTTP(nil, srv.URL+"/data", &s3seek.Options{SeekThreshold: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if off, err := s.Seek(-100, io.SeekEnd); err != nil || off != 9900 {
+		t.Fatalf("unexpected seek: %d %v", off, err)
+	}
+	b, err := ioutil.ReadAll(s)
+	if err != nil || !bytes.Equal(b, data[9900:]) {
+		t.Fatalf("wrong data after seek: %v", err)
+	}
+	s.Seek(20000, io.SeekStart)
+	if _, err := s.Read(b); err != io.EOF {
+		t.Fatalf("expected EOF past the end, got %v", err)
+	}
+
+	// a change of the ETag is detected on the next request.
+	s.Seek(0, io.SeekStart)
+	etag = `"v2"`
+	if _, err := s.Read(b); !errors.Is(err, s3seek.ErrChanged) {
+		t.Fatalf("expected ErrChanged, got %v", err)
+	}
+
+	r, err := s3seek.NewHTTP(nil, srv.URL+"/data", &s3seek.Options{ReadAhead: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, err = ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("wrong data with read-ahead: %v", err)
+	}
+
+	srv404 := httptest.NewServer(http.NotFoundHandler())
+	defer srv404.Close()
+	if _, err := s3seek.NewHTTP(nil, srv404.URL, nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected 404 error, got %v", err)
+	}
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer noRanges.Close()
+	if _, err := s3seek.NewHTTP(nil, noRanges.URL, nil); err == nil || !strings.Contains(err.Error(), "range") {
+		t.Fatalf("expected error for a server without range requests, got %v", err)
+	}
+	empty := serve(nil, &etag)
+	defer empty.Close()
+	if e, err := s3seek.NewHTTP(nil, empty.URL, nil); err != nil {
+		t.Fatalf("unexpected error for an empty file: %v", err)
+	} else if n, err := e.Read(b); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF for an empty file, got %d %v", n, err)
+	}
+	if _, err := s3seek.NewHTTP(nil, "ftp://host/file", nil); err == nil {
+		t.Error("expected error for non-http url")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	data := []byte("hello, world")
+	dir, err := ioutil.TempDir("", "s3seek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f.txt")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	etag := `"v1"`
+	srv := serve(data, &etag)
+	defer srv.Close()
+
+	for _, u := range []string{path, "file://" + path, srv.URL + "/f.txt"} {
+		s, err := s3seek.Open(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Seek(7, io.SeekStart)
+		b, err := ioutil.ReadAll(s)
+		s.Close()
+		if err != nil || string(b) != "world" {
+			t.Errorf("%s: expected world, got %q %v", u, b, err)
+		}
+	}
+	if _, err := s3seek.Open("file://relative/f.txt", nil); err == nil {
+		t.Error("expected error for a file url with a host")
+	}
+	if _, err := s3seek.Open("ftp://host/f.txt", nil); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+	if _, err := s3seek.Open(path+".missing", nil); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	// an error creating the default session is returned, not a panic.
+	t.Setenv("AWS_STS_REGIONAL_ENDPOINTS", "nowhere")
+	if _, err := s3seek.Open("s3://bucket/key", nil); err == nil {
+		t.Error("expected error for a bad aws config")
+	}
+}
@@ -0,0 +1,220 @@
+package s3seek
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// ErrChanged is the error when an object changes (its ETag differs from the
+// first response) while it is being read.
+var ErrChanged = errors.New("s3seek: object changed while reading")
+
+// Retry configures the retries of requests and reads that fail with a
+// transient error such as a connection reset, a timeout, a 5xx status or
+// throttling. Reads resume from the offset where they failed.
+type Retry struct {
+	// MaxAttempts is the most attempts for a request, including the first.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles for each retry
+	// up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry is used when no Retry is given.
+var DefaultRetry = Retry{MaxAttempts: 5, Backoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// wait before the retry that follows attempt.
+func (r *Retry) wait(ctx context.Context, attempt int) error {
+	d := r.Backoff << uint(attempt-1)
+	if d > r.MaxBackoff || d <= 0 {
+		d = r.MaxBackoff
+	}
+	// jitter so that concurrent readers don't retry together.
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transient returns whether err may succeed if retried.
+func transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && (rf.StatusCode() >= 500 || rf.StatusCode() == 429) {
+		return true
+	}
+	var he *httpError
+	if errors.As(err, &he) && (he.status >= 500 || he.status == 429) {
+		return true
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		if ae.Code() == request.CanceledErrorCode {
+			return false
+		}
+		if request.IsErrorRetryable(ae) || request.IsErrorThrottle(ae) {
+			return true
+		}
+		return transient(ae.OrigErr())
+	}
+	return false
+}
+
+// do calls f until it succeeds, fails with an error that is not transient
+// or runs out of attempts.
+func (r *Retry) do(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if !transient(err) || attempt >= r.MaxAttempts {
+			return err
+		}
+		if err := r.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// errInvalidRange is returned by a backend for a range that starts past the
+// end of the object.
+var errInvalidRange = errors.New("s3seek: invalid range")
+
+// backend makes the requests for an object in S3 or on an HTTP server.
+type backend interface {
+	// head returns the size and the ETag of the object. If ifMatch is not
+	// empty and does not match the ETag, the error is ErrChanged.
+	head(ctx context.Context, ifMatch string) (size int64, etag string, err error)
+	// get returns the body of the object from off to end (inclusive) or to
+	// the end of the object if end is -1, with the size of the object (or -1
+	// if it is not known) and its ETag. The error is errInvalidRange if off is
+	// past the end of the object and ErrChanged as for head.
+	get(ctx context.Context, off, end int64, ifMatch string) (body io.ReadCloser, size int64, etag string, err error)
+	// id identifies the object in a Cache.
+	id() string
+}
+
+// object makes the requests for an object with its backend. Requests are
+// retried as configured by retry and, after the first response, pinned to
+// its ETag. It is safe for concurrent use.
+type object struct {
+	b     backend
+	retry *Retry
+
+	mu   sync.Mutex
+	etag string
+}
+
+func newObject(b backend, retry *Retry) *object {
+	if retry == nil {
+		retry = &DefaultRetry
+	}
+	return &object{b: b, retry: retry}
+}
+
+// pin the object to etag if it is not yet pinned and return whether etag
+// matches.
+func (o *object) pin(etag string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.etag == "" {
+		o.etag = etag
+	}
+	return etag == "" || etag == o.etag
+}
+
+func (o *object) ifMatch() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.etag
+}
+
+// key identifies the object and its ETag, if known, in a Cache.
+func (o *object) key() objectKey {
+	return objectKey{id: o.b.id(), etag: o.ifMatch()}
+}
+
+// head returns the size of the object.
+func (o *object) head(ctx context.Context) (int64, error) {
+	var size int64
+	var etag string
+	err := o.retry.do(ctx, func() (err error) {
+		size, etag, err = o.b.head(ctx, o.ifMatch())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !o.pin(etag) {
+		return 0, ErrChanged
+	}
+	return size, nil
+}
+
+// get the object from off to end (inclusive) or to the end of the object if
+// end is -1. It also returns the size of the object or -1 if it is not known.
+func (o *object) get(ctx context.Context, off, end int64) (io.ReadCloser, int64, error) {
+	var body io.ReadCloser
+	var size int64
+	var etag string
+	err := o.retry.do(ctx, func() (err error) {
+		body, size, etag, err = o.b.get(ctx, off, end, o.ifMatch())
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !o.pin(etag) {
+		body.Close()
+		return nil, 0, ErrChanged
+	}
+	return body, size, nil
+}
+
+// readAt fills p with the bytes of the object from off. A read that fails
+// with a transient error is resumed with a new request.
+func (o *object) readAt(ctx context.Context, off int64, p []byte) error {
+	for attempt := 1; ; attempt++ {
+		body, _, err := o.get(ctx, off, off+int64(len(p))-1)
+		if err != nil {
+			return errors.Wrap(err, "error getting object range")
+		}
+		n, err := io.ReadFull(body, p)
+		body.Close()
+		if err == nil {
+			return nil
+		}
+		off, p = off+int64(n), p[n:]
+		if !transient(err) || attempt >= o.retry.MaxAttempts {
+			return errors.Wrap(err, "error reading object range")
+		}
+		if err := o.retry.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package s3seek
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+func TestTransient(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, true},
+		{reset, true},
+		{errors.Wrap(reset, "reading"), true},
+		{context.Canceled, false},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 500, ""), true},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), false},
+		{awserr.New("RequestError", "send request failed", reset), true},
+	} {
+		if got := transient(c.err); got != c.want {
+			t.Errorf("%v: expected %v, got %v", c.err, c.want, got)
+		}
+	}
+}
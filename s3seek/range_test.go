@@ -0,0 +1,16 @@
+package s3seek
+
+import "testing"
+
+func TestContentRangeSize(t *testing.T) {
+	for cr, want := range map[string]int64{
+		"bytes 0-99/1234":   1234,
+		"bytes 100-100/101": 101,
+		"bytes 0-99/*":      -1,
+		"":                  -1,
+	} {
+		if got := contentRangeSize(cr); got != want {
+			t.Errorf("%q: expected %d, got %d", cr, want, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package s3seek
+
+import (
+	"context"
+)
+
+// readAhead fetches the blocks ahead of the offset of a reader into its
+// cache on background goroutines.
+type readAhead struct {
+	// number of blocks after the current one to fetch.
+	n      int
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed when the fetch of each block finishes.
+	inflight map[int64]chan struct{}
+}
+
+func newReadAhead(n int) *readAhead {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readAhead{n: n, ctx: ctx, cancel: cancel, inflight: make(map[int64]chan struct{})}
+}
+
+// start fetching the blocks from the current block of er that are not
+// cached or in flight. Errors are ignored; a block that was not fetched is
+// requested again when it is read.
+func (ra *readAhead) start(er *skr, size int64) {
+	bs := er.cache.blockSize
+	obj := er.obj.key()
+	for i, done := range ra.inflight {
+		select {
+		case <-done:
+			delete(ra.inflight, i)
+		default:
+		}
+	}
+	for i := er.off / bs; i <= er.off/bs+int64(ra.n) && i*bs < size; i++ {
+		k := blockKey{obj, i}
+		if _, ok := ra.inflight[i]; ok || er.cache.has(k) {
+			continue
+		}
+		// skip blocks that another reader is fetching.
+		_, f, own := er.cache.claim(k)
+		if !own {
+			continue
+		}
+		start, end := er.cache.span(i, size)
+		done := make(chan struct{})
+		ra.inflight[i] = done
+		go func(ctx context.Context, buf []byte) {
+			defer close(done)
+			err := er.obj.readAt(ctx, start, buf)
+			if err != nil {
+				buf = nil
+			}
+			er.cache.land(k, f, buf, err)
+		}(ra.ctx, make([]byte, end-start))
+	}
+}
+
+// wait for the fetches of the blocks from off to end.
+func (ra *readAhead) wait(bs, off, end int64) {
+	for i := off / bs; i <= (end-1)/bs; i++ {
+		if done, ok := ra.inflight[i]; ok {
+			<-done
+			delete(ra.inflight, i)
+		}
+	}
+}
+
+// seek cancels the fetches if off is outside the window from old.
+func (ra *readAhead) seek(bs, old, off int64) {
+	if b := off / bs; b >= old/bs && b <= old/bs+int64(ra.n) {
+		return
+	}
+	ra.reset()
+}
+
+// reset cancels all fetches.
+func (ra *readAhead) reset() {
+	ra.cancel()
+	ra.ctx, ra.cancel = context.WithCancel(context.Background())
+	ra.inflight = make(map[int64]chan struct{})
+}
@@ -0,0 +1,41 @@
+package s3seek_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+func TestReadAhead(t *testing.T) {
+	f, data := fake(100000)
+	s, _ := s3seek.NewWithOptions(f, "bucket/key", nil, &s3seek.Options{
+		Cache: s3seek.NewCache(1000, 20000), ReadAhead: 4})
+	defer s.Close()
+	var b []byte
+	p := make([]byte, 300)
+	for {
+		n, err := s.Read(p)
+		b = append(b, p[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatal("wrong data")
+	}
+	// each block is requested once in the background.
+	if n := f.Requests("GetObject"); n != 100 {
+		t.Errorf("expected about 100 block requests, got %d", n)
+	}
+	// a seek outside the window.
+	p = make([]byte, 3000)
+	s.Seek(5500, io.SeekStart)
+	if _, err := io.ReadFull(s, p); err != nil || !bytes.Equal(p, data[5500:8500]) {
+		t.Fatalf("wrong data after seek: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package s3seek
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// DefaultChunkSize is the default ReaderAt.ChunkSize.
+const DefaultChunkSize = 8 << 20
+
+// DefaultConcurrency is the default ReaderAt.Concurrency.
+const DefaultConcurrency = 8
+
+// ReaderAt implements io.ReaderAt for an S3 object. Each ReadAt makes its
+// own ranged requests so, unlike the reader from New, it is safe to use from
+// multiple goroutines at once.
+type ReaderAt struct {
+	obj  *object
+	size int64
+	// ChunkSize is the largest range requested at once. Larger reads are
+	// split into chunks that are requested in parallel.
+	ChunkSize int
+	// Concurrency is the most requests in flight for a single ReadAt.
+	Concurrency int
+	// Cache, if given, serves reads from its blocks. Runs of blocks that are
+	// not in the Cache are requested at once, ignoring the ChunkSize.
+	Cache *Cache
+	// Retry configures the retries of transient errors. It is DefaultRetry
+	// from NewReaderAt.
+	Retry Retry
+}
+
+// NewReaderAt returns a ReaderAt for the object given by path or goi as
+// for New. The size of the object is requested with HeadObject.
+func NewReaderAt(c Client, path string, goi *s3.GetObjectInput) (*ReaderAt, error) {
+	goi, err := objectInput(path, goi)
+	if err != nil {
+		return nil, err
+	}
+	ra := &ReaderAt{ChunkSize: DefaultChunkSize, Concurrency: DefaultConcurrency, Retry: DefaultRetry}
+	ra.obj = newObject(&s3Object{s3: c, oi: goi}, &ra.Retry)
+	// this also pins the reads to the ETag of the object.
+	if ra.size, err = ra.obj.head(context.Background()); err != nil {
+		return nil, errors.Wrap(err, "error getting object size")
+	}
+	return ra, nil
+}
+
+// Size returns the size of the object.
+func (ra *ReaderAt) Size() int64 {
+	return ra.size
+}
+
+// ReadAt implements io.ReaderAt. It returns io.EOF if the read goes past the
+// end of the object.
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("s3seek: negative offset: %d", off)
+	}
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var eof error
+	if int64(len(p)) > ra.size-off {
+		p = p[:ra.size-off]
+		eof = io.EOF
+	}
+	if ra.Cache != nil {
+		if err := ra.Cache.readAt(context.Background(), ra.obj.readAt, ra.obj.key(), ra.size, p, off); err != nil {
+			return 0, err
+		}
+		return len(p), eof
+	}
+	chunk := ra.ChunkSize
+	if chunk <= 0 {
+		chunk = DefaultChunkSize
+	}
+	conc := ra.Concurrency
+	if conc <= 0 {
+		conc = 1
+	}
+	if len(p) <= chunk {
+		if err := ra.obj.readAt(context.Background(), off, p); err != nil {
+			return 0, err
+		}
+		return len(p), eof
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sem := make(chan struct{}, conc)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var err error
+	for i := 0; i < len(p) && ctx.Err() == nil; i += chunk {
+		j := i + chunk
+		if j > len(p) {
+			j = len(p)
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i, j int) {
+			defer func() { <-sem; wg.Done() }()
+			if e := ra.obj.readAt(ctx, off+int64(i), p[i:j]); e != nil {
+				mu.Lock()
+				// keep the first error; the others are from the cancel.
+				if err == nil {
+					err = e
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i, j)
+	}
+	wg.Wait()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), eof
+}
@@ -0,0 +1,68 @@
+package s3seek_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+func TestReaderAt(t *testing.T) {
+	f, data := fake(100000)
+	ra, err := s3seek.NewReaderAt(f, "bucket/key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra.Size() != int64(len(data)) {
+		t.Fatalf("wrong size: %d", ra.Size())
+	}
+	ra.ChunkSize = 1000
+	ra.Concurrency = 4
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for j := 0; j < 10; j++ {
+				off := rng.Int63n(int64(len(data)))
+				p := make([]byte, rng.Intn(5000))
+				n, err := ra.ReadAt(p, off)
+				if want := int64(len(data)) - off; want < int64(len(p)) {
+					if err != io.EOF || int64(n) != want {
+						t.Errorf("expected EOF after %d bytes, got %d %v", want, n, err)
+						return
+					}
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+					t.Errorf("wrong data at %d", off)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	if _, err := ra.ReadAt(make([]byte, 1), int64(len(data))); err != io.EOF {
+		t.Errorf("expected EOF at end, got %v", err)
+	}
+
+	// a large read is split into chunks.
+	n := f.Requests("GetObject")
+	if _, err := ra.ReadAt(make([]byte, 10000), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Requests("GetObject") - n; got != 10 {
+		t.Errorf("expected 10 chunk requests, got %d", got)
+	}
+	// an empty read makes no request.
+	n = f.Requests("GetObject")
+	if m, err := ra.ReadAt(nil, 10); m != 0 || err != nil || f.Requests("GetObject") != n {
+		t.Errorf("expected an empty read with no request, got %d %v", m, err)
+	}
+}
@@ -1,12 +1,18 @@
-// Package s3seek provides a seekable io.Reader to an S3 object.
+// Package s3seek provides a seekable io.Reader to an S3 object or a file on
+// an HTTP(S) server.
 package s3seek
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
 )
@@ -18,75 +24,335 @@ type ReadSeekCloser interface {
 }
 
 type skr struct {
-	oi *s3.GetObjectInput
-	oo *s3.GetObjectOutput
-	s3 *s3.S3
+	obj  *object
+	body io.ReadCloser
+	// offset of the next Read.
+	off int64
+	// offset of the open body which may be behind off after a Seek.
+	pos int64
+	// forward seeks of up to threshold bytes discard from the open body.
+	threshold int64
+	// size of the object or -1 if it is not yet known.
+	size int64
+	// cache, if not nil, is used for all reads instead of a single body.
+	cache *Cache
+	// ahead is set for Options.ReadAhead.
+	ahead *readAhead
 }
 
-// Close the underlying S3 reader.
+// DefaultSeekThreshold is the default Options.SeekThreshold.
+const DefaultSeekThreshold = 1 << 20
+
+// Options for NewWithOptions, NewHTTP and Open.
+type Options struct {
+	// SeekThreshold is the largest forward seek for which the reader reads
+	// and discards from the open body instead of making a new request.
+	// Default is DefaultSeekThreshold; use a negative value to always make a
+	// new request.
+	SeekThreshold int64
+	// Cache, if given, serves reads from its blocks. Blocks that are not in
+	// the Cache are requested with ranged GETs and seeks make no requests.
+	// Use NewDiskCache to also keep the blocks on disk across processes.
+	Cache *Cache
+	// ReadAhead is the number of blocks after the current one to fetch on
+	// background goroutines for fast sequential reads. Seeking outside of
+	// these blocks cancels the fetches. If Cache is nil, a Cache that holds
+	// ReadAhead+2 blocks of DefaultBlockSize is used.
+	ReadAhead int
+	// Retry configures the retries of transient errors. Default is
+	// DefaultRetry.
+	Retry *Retry
+	// S3 and HTTPClient are the clients used by Open.
+	S3         Client
+	HTTPClient *http.Client
+}
+
+// Close the underlying reader.
 func (er *skr) Close() error {
-	if er.oo == nil {
+	if er.ahead != nil {
+		er.ahead.reset()
+	}
+	return er.closeBody()
+}
+
+func (er *skr) closeBody() error {
+	if er.body == nil {
 		return nil
 	}
-	err := er.oo.Body.Close()
-	er.oo = nil
+	err := er.body.Close()
+	er.body = nil
 	return err
 
 }
 
-// Seek to the specified offset; whence must be 0.
+// Seek sets the offset for the next Read as described by io.Seeker. No
+// request is made until the next Read, which reads on from the open body for
+// a short forward seek (see Options.SeekThreshold). Seeking to io.SeekEnd
+// requires the size of the object which is requested (e.g. with HeadObject)
+// if it is not yet known. As with an os.File, it is not an error
+// to seek past the end of the object; Read will then return io.EOF.
 func (er *skr) Seek(offset int64, whence int) (int64, error) {
-	if whence != 0 {
-		return 0, fmt.Errorf("s3seek: Seek only accepts 0 for whence argument")
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += er.off
+	case io.SeekEnd:
+		size, err := er.getSize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("s3seek: invalid whence: %d", whence)
 	}
-	var err error
-	if err = er.Close(); err != nil {
-		return 0, err
+	if offset < 0 {
+		return 0, fmt.Errorf("s3seek: negative position: %d", offset)
 	}
-
-	if err := er.setRange(offset); err != nil {
-		return 0, err
+	if er.ahead != nil {
+		er.ahead.seek(er.cache.blockSize, er.off, offset)
 	}
+	er.off = offset
 	return offset, nil
 }
 
+// getSize returns the size of the object, requesting it if it is not yet known.
+func (er *skr) getSize() (int64, error) {
+	if er.size >= 0 {
+		return er.size, nil
+	}
+	size, err := er.obj.head(context.Background())
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting object size")
+	}
+	er.size = size
+	return er.size, nil
+}
+
+// setRange opens the object from offset. Nothing is opened at or past the
+// end of the object.
 func (er *skr) setRange(offset int64) error {
-	er.oi.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
-	var err error
-	er.oo, err = er.s3.GetObject(er.oi)
-	return errors.Wrap(err, "error getting object from s3")
+	if er.size >= 0 && offset >= er.size {
+		return nil
+	}
+	body, size, err := er.obj.get(context.Background(), offset, -1)
+	if err == errInvalidRange {
+		// offset is past the end of the object.
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "error getting object")
+	}
+	if size >= 0 {
+		er.size = size
+	}
+	er.body, er.pos = body, offset
+	return nil
+}
+
+// contentRangeSize returns the size of an object from the Content-Range of a
+// response, e.g. "bytes 0-99/1234", or -1 if it is not known.
+func contentRangeSize(cr string) int64 {
+	i := strings.LastIndexByte(cr, '/')
+	if i == -1 {
+		return -1
+	}
+	size, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
 }
 
 // Read implements io.Reader
 func (er *skr) Read(p []byte) (int, error) {
-	if er.oo == nil {
-		var err error
-		er.oo, err = er.s3.GetObject(er.oi)
-		if err != nil {
-			return 0, errors.Wrap(err, "error getting object from S3")
+	if er.cache != nil {
+		return er.readCached(p)
+	}
+	if er.body != nil && er.pos != er.off {
+		if d := er.off - er.pos; d < 0 || d > er.threshold || !er.discard(d) {
+			if err := er.closeBody(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		if er.body == nil {
+			if err := er.setRange(er.off); err != nil {
+				return 0, err
+			}
+			if er.body == nil {
+				return 0, io.EOF
+			}
 		}
+		n, err := er.body.Read(p)
+		er.off += int64(n)
+		er.pos += int64(n)
+		if !transient(err) || attempt >= er.obj.retry.MaxAttempts {
+			return n, err
+		}
+		// resume from the offset with a new request which is pinned to the
+		// ETag of the first so a changed object is not spliced in.
+		er.closeBody()
+		if n > 0 {
+			return n, nil
+		}
+		if err := er.obj.retry.wait(context.Background(), attempt); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// discard n bytes from the open body and return whether it succeeded.
+func (er *skr) discard(n int64) bool {
+	m, err := io.CopyN(ioutil.Discard, er.body, n)
+	er.pos += m
+	return err == nil
+}
+
+// readCached reads from the cache.
+func (er *skr) readCached(p []byte) (int, error) {
+	size, err := er.getSize()
+	if err != nil {
+		return 0, err
 	}
-	return er.oo.Body.Read(p)
+	if er.off >= size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-er.off {
+		p = p[:size-er.off]
+	}
+	if er.ahead != nil {
+		er.ahead.start(er, size)
+		er.ahead.wait(er.cache.blockSize, er.off, er.off+int64(len(p)))
+	}
+	if err := er.cache.readAt(context.Background(), er.obj.readAt, er.obj.key(), size, p, er.off); err != nil {
+		return 0, err
+	}
+	er.off += int64(len(p))
+	return len(p), nil
+}
+
+// New returns a io.ReadSeeker that makes its requests with c, e.g. an *s3.S3.
+// If goi is nil then just the path is used and must contain the bucket prefix
+// and the object (key) path; any s3:// prefix is optional. If goi is non nil,
+// path will be ignored and the goi will be used to determine the bucket and
+// key and to set any additional options. The Range of goi is set by the reader.
+func New(c Client, path string, goi *s3.GetObjectInput) (ReadSeekCloser, error) {
+	goi, err := objectInput(path, goi)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(&s3Object{s3: c, oi: goi}, nil), nil
+}
+
+// NewWithOptions returns a io.ReadSeeker as for New using the given Options.
+func NewWithOptions(c Client, path string, goi *s3.GetObjectInput, opts *Options) (ReadSeekCloser, error) {
+	goi, err := objectInput(path, goi)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(&s3Object{s3: c, oi: goi}, opts), nil
 }
 
-// New returns a io.ReadSeeker. If goi is nil then just the path is used and
-// must contain the bucket prefix and the object (key) path; any s3:// prefix
-// is optional. If goi is non nil, path will be ignored and the goi will be
-// used to determine the bucket and key and to set any additional options.
-func New(c *s3.S3, path string, goi *s3.GetObjectInput) (ReadSeekCloser, error) {
-	if goi == nil {
-		goi = &s3.GetObjectInput{}
-		if strings.HasPrefix(path, "s3://") {
-			path = path[5:]
+// newReader returns a reader of the object of b. opts may be nil.
+func newReader(b backend, opts *Options) *skr {
+	er := &skr{obj: newObject(b, nil), size: -1, threshold: DefaultSeekThreshold}
+	if opts == nil {
+		return er
+	}
+	if opts.SeekThreshold != 0 {
+		er.threshold = opts.SeekThreshold
+	}
+	if opts.Retry != nil {
+		er.obj.retry = opts.Retry
+	}
+	er.cache = opts.Cache
+	if opts.ReadAhead > 0 {
+		if er.cache == nil {
+			er.cache = NewCache(DefaultBlockSize, int64(opts.ReadAhead+2)*DefaultBlockSize)
 		}
+		er.ahead = newReadAhead(opts.ReadAhead)
+	}
+	return er
+}
 
-		bucketRest := strings.SplitN(path, "/", 2)
-		if len(bucketRest) < 2 {
-			return nil, fmt.Errorf("s3seek: expected a bucket and a key. got %s", path)
+// objectInput returns goi or, if it is nil, an input for the bucket and key in path.
+func objectInput(path string, goi *s3.GetObjectInput) (*s3.GetObjectInput, error) {
+	if goi != nil {
+		return goi, nil
+	}
+	goi = &s3.GetObjectInput{}
+	if strings.HasPrefix(path, "s3://") {
+		path = path[5:]
+	}
+
+	bucketRest := strings.SplitN(path, "/", 2)
+	if len(bucketRest) < 2 {
+		return nil, fmt.Errorf("s3seek: expected a bucket and a key. got %s", path)
+	}
+	goi.Bucket = aws.String(bucketRest[0])
+	goi.Key = aws.String(bucketRest[1])
+	return goi, nil
+}
+
+// s3Object is the backend for an object in S3.
+type s3Object struct {
+	s3 Client
+	oi *s3.GetObjectInput
+}
+
+func (o *s3Object) ifMatch(etag string) *string {
+	if o.oi.IfMatch != nil || etag == "" {
+		return o.oi.IfMatch
+	}
+	return aws.String(etag)
+}
+
+func (o *s3Object) head(ctx context.Context, ifMatch string) (int64, string, error) {
+	goi := o.oi
+	ho, err := o.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: goi.Bucket, Key: goi.Key,
+		VersionId: goi.VersionId, RequestPayer: goi.RequestPayer, IfMatch: o.ifMatch(ifMatch),
+		SSECustomerAlgorithm: goi.SSECustomerAlgorithm, SSECustomerKey: goi.SSECustomerKey,
+		SSECustomerKeyMD5: goi.SSECustomerKeyMD5})
+	if err != nil {
+		return 0, "", s3Error(err)
+	}
+	return aws.Int64Value(ho.ContentLength), aws.StringValue(ho.ETag), nil
+}
+
+func (o *s3Object) get(ctx context.Context, off, end int64, ifMatch string) (io.ReadCloser, int64, string, error) {
+	oi := *o.oi
+	if end == -1 {
+		oi.Range = aws.String(fmt.Sprintf("bytes=%d-", off))
+	} else {
+		oi.Range = aws.String(fmt.Sprintf("bytes=%d-%d", off, end))
+	}
+	oi.IfMatch = o.ifMatch(ifMatch)
+	oo, err := o.s3.GetObjectWithContext(ctx, &oi)
+	if err != nil {
+		return nil, 0, "", s3Error(err)
+	}
+	return oo.Body, contentRangeSize(aws.StringValue(oo.ContentRange)), aws.StringValue(oo.ETag), nil
+}
+
+// s3Error returns errInvalidRange and ErrChanged for the errors from S3
+// with those meanings.
+func s3Error(err error) error {
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		switch rf.StatusCode() {
+		case 416:
+			return errInvalidRange
+		case 412:
+			return ErrChanged
 		}
-		goi.Bucket = aws.String(bucketRest[0])
-		goi.Key = aws.String(bucketRest[1])
 	}
-	er := &skr{oi: goi, s3: c}
-	return er, nil
+	return err
+}
+
+func (o *s3Object) id() string {
+	id := "s3://" + aws.StringValue(o.oi.Bucket) + "/" + aws.StringValue(o.oi.Key)
+	if v := aws.StringValue(o.oi.VersionId); v != "" {
+		id += "?versionId=" + v
+	}
+	return id
 }
@@ -1,99 +1,222 @@
 package s3seek_test
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/brentp/go-athenaeum/s3seek"
+	"github.com/brentp/go-athenaeum/s3seek/fakes3"
 )
 
-func TestRead(t *testing.T) {
-	sess := session.Must(session.NewSession())
-	svc := s3.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+var fastRetry = &s3seek.Retry{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
 
-	s, err := s3seek.New(svc, "s3://1000genomes/20131219.populations.tsv", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+var _ s3seek.Client = fakes3.New()
 
-	r := bufio.NewReader(s)
-	l1, err := r.ReadString('\n')
+func fake(n int) (*fakes3.S3, []byte) {
+	f := fakes3.New()
+	data := make([]byte, n)
+	rand.Read(data)
+	f.Put("bucket", "key", data)
+	return f, data
+}
+
+func TestRead(t *testing.T) {
+	f, data := fake(10000)
+	s, err := s3seek.New(f, "s3://bucket/key", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	l2, err := r.ReadString('\n')
+	defer s.Close()
+	b, err := ioutil.ReadAll(s)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = r.ReadString('\n')
-	if err != nil {
-		t.Fatal(err)
+	if !bytes.Equal(b, data) {
+		t.Fatal("wrong data")
 	}
+	if _, err := s3seek.New(f, "bucket", nil); err == nil {
+		t.Error("expected error for path without key")
+	}
+	s, _ = s3seek.New(f, "bucket/missing", nil)
+	if _, err := s.Read(b); err == nil {
+		t.Error("expected error for missing key")
+	}
+}
 
-	_, err = s.Seek(int64(len(l1)), 0)
-	if err != nil {
-		t.Fatal(err)
+func TestSeek(t *testing.T) {
+	f, data := fake(1000)
+	s, _ := s3seek.New(f, "bucket/key", nil)
+	defer s.Close()
+	p := make([]byte, 10)
+	for _, c := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{100, io.SeekStart, 100},
+		{10, io.SeekCurrent, 120},
+		{-10, io.SeekEnd, 990},
+		{-20, io.SeekCurrent, 980},
+	} {
+		off, err := s.Seek(c.offset, c.whence)
+		if err != nil || off != c.want {
+			t.Fatalf("Seek(%d, %d): expected %d, got %d %v", c.offset, c.whence, c.want, off, err)
+		}
+		if _, err := io.ReadFull(s, p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, data[off:off+10]) {
+			t.Fatalf("wrong data after Seek(%d, %d)", c.offset, c.whence)
+		}
+	}
+	// like an os.File, seeking past the end is not an error.
+	if off, err := s.Seek(10, io.SeekEnd); err != nil || off != 1010 {
+		t.Fatalf("unexpected seek past end: %d %v", off, err)
+	}
+	if n, err := s.Read(p); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF past end, got %d %v", n, err)
+	}
+	if _, err := s.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected error for negative position")
+	}
+	if _, err := s.Seek(0, 3); err == nil {
+		t.Error("expected error for bad whence")
 	}
+}
 
-	r = bufio.NewReader(s)
-	l22, err := r.ReadString('\n')
-	if err != nil {
-		t.Fatal(err)
+func TestCache(t *testing.T) {
+	f, data := fake(10000)
+	c := s3seek.NewCache(100, 1000)
+	s, _ := s3seek.NewWithOptions(f, "bucket/key", nil, &s3seek.Options{Cache: c})
+	defer s.Close()
+	p := make([]byte, 250)
+	for i := 0; i < 3; i++ {
+		s.Seek(5050, io.SeekStart)
+		if _, err := io.ReadFull(s, p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, data[5050:5300]) {
+			t.Fatal("wrong data")
+		}
+	}
+	// the 3 blocks are requested at once and then read from the cache.
+	if n := f.Requests("GetObject"); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
 	}
 
-	if l2 != l22 {
-		t.Fatal("error seeking. expected line 2 from test file")
+	// the cache is shared with a ReaderAt of the same object.
+	ra, _ := s3seek.NewReaderAt(f, "bucket/key", nil)
+	ra.Cache = c
+	if _, err := ra.ReadAt(p, 4900); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[4900:5150]) {
+		t.Fatal("wrong data")
+	}
+	if n := f.Requests("GetObject"); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
 	}
 
+	s.Seek(-10, io.SeekEnd)
+	if b, err := ioutil.ReadAll(s); err != nil || !bytes.Equal(b, data[len(data)-10:]) {
+		t.Fatalf("wrong data at end: %v", err)
+	}
 }
 
-/*
-func TestBam(t *testing.T) {
-	sess := session.Must(session.NewSession())
-	svc := s3.New(sess, aws.NewConfig().WithRegion("us-east-1"))
-
-	s, err := s3seek.New(svc, "s3://1000genomes/phase3/data/NA12878/high_coverage_alignment/NA12878.mapped.ILLUMINA.bwa.CEU.high_coverage_pcr_free.20130906.bam.bai", nil)
+func TestResume(t *testing.T) {
+	f, data := fake(10000)
+	s, _ := s3seek.NewWithOptions(f, "bucket/key", nil, &s3seek.Options{Retry: fastRetry})
+	defer s.Close()
+	f.Cut(1000)
+	f.Cut(1000)
+	f.Fail("GetObject", fakes3.ServerError())
+	b, err := ioutil.ReadAll(s)
 	if err != nil {
 		t.Fatal(err)
 	}
-	idx, err := bam.ReadIndex(s)
-	if err != nil {
-		t.Fatal(err)
+	if !bytes.Equal(b, data) {
+		t.Fatal("wrong data")
+	}
+	if n := f.Requests("GetObject"); n != 4 {
+		t.Errorf("expected 4 requests, got %d", n)
 	}
 
-	s.Close()
+	ra, _ := s3seek.NewReaderAt(f, "bucket/key", nil)
+	ra.Retry = *fastRetry
+	f.Cut(10)
+	p := make([]byte, 100)
+	if _, err := ra.ReadAt(p, 500); err != nil || !bytes.Equal(p, data[500:600]) {
+		t.Fatalf("wrong data from resumed ReadAt: %v", err)
+	}
 
-	s, err = s3seek.New(svc, "s3://1000genomes/phase3/data/NA12878/high_coverage_alignment/NA12878.mapped.ILLUMINA.bwa.CEU.high_coverage_pcr_free.20130906.bam", nil)
-	if err != nil {
-		t.Fatal(err)
+	// too many errors.
+	for i := 0; i < 3; i++ {
+		f.Cut(0)
+	}
+	if _, err := ra.ReadAt(p, 0); err == nil {
+		t.Error("expected error after 3 attempts")
 	}
-	defer s.Close()
 
-	b, err := bam.NewReader(s, 1)
-	if err != nil {
+	// a changed object is not spliced in.
+	s.Seek(0, io.SeekStart)
+	f.Cut(10)
+	if _, err := s.Read(p); err != nil {
 		t.Fatal(err)
 	}
-	defer b.Close()
-
-	ref := b.Header().Refs()[4]
+	f.Put("bucket", "key", []byte("changed"))
+	if _, err := ioutil.ReadAll(s); !errors.Is(err, s3seek.ErrChanged) {
+		t.Errorf("expected ErrChanged, got %v", err)
+	}
+	if _, err := ra.ReadAt(p, 0); !errors.Is(err, s3seek.ErrChanged) {
+		t.Errorf("expected ErrChanged, got %v", err)
+	}
+}
 
-	chunks, err := idx.Chunks(ref, 45000000, 45000100)
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3seek")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	bi, err := bam.NewIterator(b, chunks)
-
-	for bi.Next() {
-		rec := bi.Record()
-		fmt.Println(rec.Ref.Name(), rec.Start())
+	defer os.RemoveAll(dir)
+	f, data := fake(10000)
+	read := func() []byte {
+		c, err := s3seek.NewDiskCache(dir, 1000, 0, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := s3seek.NewWithOptions(f, "bucket/key", nil, &s3seek.Options{Cache: c})
+		defer s.Close()
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
 	}
-	if err = bi.Error(); err != nil {
-		t.Fatal(err)
+	if !bytes.Equal(read(), data) {
+		t.Fatal("wrong data")
+	}
+	n := f.Requests("GetObject")
+	// a second reader, as in another process, only makes a HeadObject.
+	if !bytes.Equal(read(), data) {
+		t.Fatal("wrong data")
+	}
+	if m := f.Requests("GetObject"); m != n {
+		t.Errorf("expected %d requests, got %d", n, m)
 	}
 
+	// a new version of the object has a new ETag so it is requested again.
+	rand.Read(data)
+	f.Put("bucket", "key", data)
+	if !bytes.Equal(read(), data) {
+		t.Fatal("wrong data after the object changed")
+	}
+	if m := f.Requests("GetObject"); m == n {
+		t.Error("expected new requests for the new version")
+	}
 }
-*/
@@ -0,0 +1,143 @@
+// Package s3v2 adapts an S3 client from aws-sdk-go-v2 to s3seek.Client.
+package s3v2
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	s3v1 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+// API is the part of *s3.Client used by the adapter.
+type API interface {
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+type client struct {
+	c API
+}
+
+// New returns a s3seek.Client that makes its requests with c, e.g. from
+// s3.NewFromConfig. Errors with an HTTP response are returned as an
+// awserr.RequestFailure so that s3seek can tell which can be retried.
+func New(c API) s3seek.Client {
+	return &client{c: c}
+}
+
+// convert an error with an HTTP response to an awserr.RequestFailure.
+func convert(err error) error {
+	var re *smithyhttp.ResponseError
+	if err == nil || !errors.As(err, &re) {
+		return err
+	}
+	code, msg := strconv.Itoa(re.HTTPStatusCode()), err.Error()
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		code, msg = ae.ErrorCode(), ae.ErrorMessage()
+	}
+	return awserr.NewRequestFailure(awserr.New(code, msg, err), re.HTTPStatusCode(), "")
+}
+
+func int32p(v *int64) *int32 {
+	if v == nil {
+		return nil
+	}
+	i := int32(*v)
+	return &i
+}
+
+func (c *client) GetObjectWithContext(ctx aws.Context, in *s3v1.GetObjectInput, _ ...request.Option) (*s3v1.GetObjectOutput, error) {
+	out, err := c.c.GetObject(ctx, &s3.GetObjectInput{Bucket: in.Bucket, Key: in.Key, Range: in.Range,
+		IfMatch: in.IfMatch, VersionId: in.VersionId, PartNumber: int32p(in.PartNumber),
+		RequestPayer:         types.RequestPayer(aws.StringValue(in.RequestPayer)),
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm, SSECustomerKey: in.SSECustomerKey,
+		SSECustomerKeyMD5: in.SSECustomerKeyMD5})
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.GetObjectOutput{Body: out.Body, ContentLength: out.ContentLength,
+		ContentRange: out.ContentRange, ContentType: out.ContentType, ETag: out.ETag,
+		VersionId: out.VersionId}, nil
+}
+
+func (c *client) HeadObjectWithContext(ctx aws.Context, in *s3v1.HeadObjectInput, _ ...request.Option) (*s3v1.HeadObjectOutput, error) {
+	out, err := c.c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: in.Bucket, Key: in.Key,
+		IfMatch: in.IfMatch, VersionId: in.VersionId,
+		RequestPayer:         types.RequestPayer(aws.StringValue(in.RequestPayer)),
+		SSECustomerAlgorithm: in.SSECustomerAlgorithm, SSECustomerKey: in.SSECustomerKey,
+		SSECustomerKeyMD5: in.SSECustomerKeyMD5})
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.HeadObjectOutput{ContentLength: out.ContentLength, ContentType: out.ContentType,
+		ETag: out.ETag, VersionId: out.VersionId}, nil
+}
+
+func (c *client) CreateMultipartUploadWithContext(ctx aws.Context, in *s3v1.CreateMultipartUploadInput, _ ...request.Option) (*s3v1.CreateMultipartUploadOutput, error) {
+	ci := &s3.CreateMultipartUploadInput{Bucket: in.Bucket, Key: in.Key,
+		CacheControl: in.CacheControl, ContentEncoding: in.ContentEncoding, ContentType: in.ContentType,
+		ServerSideEncryption: types.ServerSideEncryption(aws.StringValue(in.ServerSideEncryption)),
+		SSEKMSKeyId:          in.SSEKMSKeyId, StorageClass: types.StorageClass(aws.StringValue(in.StorageClass))}
+	if in.Metadata != nil {
+		ci.Metadata = make(map[string]string, len(in.Metadata))
+		for k, v := range in.Metadata {
+			ci.Metadata[k] = aws.StringValue(v)
+		}
+	}
+	out, err := c.c.CreateMultipartUpload(ctx, ci)
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.CreateMultipartUploadOutput{Bucket: out.Bucket, Key: out.Key, UploadId: out.UploadId}, nil
+}
+
+func (c *client) UploadPartWithContext(ctx aws.Context, in *s3v1.UploadPartInput, _ ...request.Option) (*s3v1.UploadPartOutput, error) {
+	out, err := c.c.UploadPart(ctx, &s3.UploadPartInput{Bucket: in.Bucket, Key: in.Key,
+		UploadId: in.UploadId, PartNumber: int32p(in.PartNumber), Body: in.Body,
+		ContentLength: in.ContentLength})
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.UploadPartOutput{ETag: out.ETag}, nil
+}
+
+func (c *client) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3v1.CompleteMultipartUploadInput, _ ...request.Option) (*s3v1.CompleteMultipartUploadOutput, error) {
+	ci := &s3.CompleteMultipartUploadInput{Bucket: in.Bucket, Key: in.Key, UploadId: in.UploadId}
+	if in.MultipartUpload != nil {
+		ci.MultipartUpload = &types.CompletedMultipartUpload{}
+		for _, p := range in.MultipartUpload.Parts {
+			ci.MultipartUpload.Parts = append(ci.MultipartUpload.Parts,
+				types.CompletedPart{ETag: p.ETag, PartNumber: int32p(p.PartNumber)})
+		}
+	}
+	out, err := c.c.CompleteMultipartUpload(ctx, ci)
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.CompleteMultipartUploadOutput{ETag: out.ETag, Location: out.Location}, nil
+}
+
+func (c *client) AbortMultipartUploadWithContext(ctx aws.Context, in *s3v1.AbortMultipartUploadInput, _ ...request.Option) (*s3v1.AbortMultipartUploadOutput, error) {
+	_, err := c.c.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: in.Bucket, Key: in.Key,
+		UploadId: in.UploadId})
+	if err != nil {
+		return nil, convert(err)
+	}
+	return &s3v1.AbortMultipartUploadOutput{}, nil
+}
+
+var _ API = (*s3.Client)(nil)
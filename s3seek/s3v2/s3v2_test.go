@@ -0,0 +1,72 @@
+package s3v2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+// mock serves GetObject and HeadObject from data after failing the first
+// GetObject with a 503.
+type mock struct {
+	API
+	data   []byte
+	failed bool
+}
+
+func responseError(status int, code string) error {
+	return &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err: &smithy.GenericAPIError{Code: code, Message: code}}
+}
+
+func (m *mock) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if !m.failed {
+		m.failed = true
+		return nil, responseError(503, "SlowDown")
+	}
+	var start int64
+	fmt.Sscanf(aws.ToString(in.Range), "bytes=%d-", &start)
+	if start >= int64(len(m.data)) {
+		return nil, responseError(416, "InvalidRange")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.data[start:])),
+		ContentLength: aws.Int64(int64(len(m.data)) - start), ETag: aws.String(`"etag"`),
+		ContentRange: aws.String(fmt.Sprintf("bytes %d-%d/%d", start, len(m.data)-1, len(m.data)))}, nil
+}
+
+func (m *mock) HeadObject(ctx context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(m.data))), ETag: aws.String(`"etag"`)}, nil
+}
+
+func TestAdapter(t *testing.T) {
+	m := &mock{data: []byte("hello world")}
+	r, err := s3seek.NewWithOptions(New(m), "bucket/key", nil, &s3seek.Options{
+		Retry: &s3seek.Retry{MaxAttempts: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	// the 503 is retried.
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "world" {
+		t.Fatalf("unexpected read: %q %v", b, err)
+	}
+	// the 416 for a reader that does not know the size is the end of the object.
+	r, _ = s3seek.New(New(m), "bucket/key", nil)
+	r.Seek(20, io.SeekStart)
+	if n, err := r.Read(b); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF, got %d %v", n, err)
+	}
+}
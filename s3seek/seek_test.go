@@ -0,0 +1,44 @@
+package s3seek_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/brentp/go-athenaeum/s3seek"
+)
+
+func TestLazySeek(t *testing.T) {
+	f, data := fake(1000)
+	s, _ := s3seek.NewWithOptions(f, "bucket/key", nil, &s3seek.Options{SeekThreshold: 100})
+	defer s.Close()
+	s.Seek(500, io.SeekStart)
+	s.Seek(10, io.SeekStart)
+	if n := f.Requests("GetObject"); n != 0 {
+		t.Fatalf("expected no requests for seeks, got %d", n)
+	}
+	p := make([]byte, 10)
+	check := func(off int64, requests int) {
+		t.Helper()
+		if _, err := io.ReadFull(s, p); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, data[off:off+10]) {
+			t.Fatalf("wrong data at %d", off)
+		}
+		if n := f.Requests("GetObject"); n != requests {
+			t.Fatalf("expected %d requests, got %d", requests, n)
+		}
+	}
+	check(10, 1)
+	// short forward seeks read from the same body.
+	s.Seek(50, io.SeekCurrent)
+	check(70, 1)
+	s.Seek(100, io.SeekStart)
+	check(100, 1)
+	// long and backward seeks need a new request.
+	s.Seek(500, io.SeekStart)
+	check(500, 2)
+	s.Seek(0, io.SeekStart)
+	check(0, 3)
+}
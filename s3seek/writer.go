@@ -0,0 +1,263 @@
+package s3seek
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// DefaultPartSize is the default WriterOptions.PartSize. S3 requires parts
+// of at least 5 MiB, except for the last.
+const DefaultPartSize = 8 << 20
+
+// maxParts is the most parts in a multipart upload.
+const maxParts = 10000
+
+// WriterOptions for NewWriter.
+type WriterOptions struct {
+	// PartSize is the size of each part. Default is DefaultPartSize. The
+	// largest object that can be written is 10000 * PartSize.
+	PartSize int
+	// Concurrency is the most parts uploaded at once. Write blocks when
+	// this many are in flight so the Writer holds at most Concurrency+1
+	// parts in memory. Default is DefaultConcurrency.
+	Concurrency int
+	// Retry configures the retries of transient errors. Default is
+	// DefaultRetry.
+	Retry *Retry
+	// Input, if given, is used to create the upload, e.g. to set the
+	// ContentType or encryption. Its Bucket and Key are set from the path.
+	Input *s3.CreateMultipartUploadInput
+}
+
+// Writer is an io.WriteCloser that streams to an S3 object with a multipart
+// upload. The object is only created by Close. If any part fails, or Abort
+// is called, the upload is aborted so that no parts are left in S3, even if
+// Close is not called.
+type Writer struct {
+	s3    Client
+	ci    s3.CreateMultipartUploadInput
+	retry *Retry
+	size  int
+	ctx   context.Context
+	// cancel the uploads of parts.
+	cancel context.CancelFunc
+
+	// set when the upload is created by the first part.
+	uploadID *string
+	buf      []byte
+	part     int64
+	// has a value for each part in flight.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu     sync.Mutex
+	parts  []*s3.CompletedPart
+	err    error
+	closed bool
+	// closed once the upload is aborted after the first error.
+	aborted  chan struct{}
+	abortErr error
+}
+
+// NewWriter returns a Writer to the object at path, which must contain the
+// bucket and the key as for New. opts may be nil.
+func NewWriter(c Client, path string, opts *WriterOptions) (*Writer, error) {
+	goi, err := objectInput(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	w := &Writer{s3: c, retry: opts.Retry, size: opts.PartSize}
+	if opts.Input != nil {
+		w.ci = *opts.Input
+	}
+	w.ci.Bucket, w.ci.Key = goi.Bucket, goi.Key
+	if w.retry == nil {
+		w.retry = &DefaultRetry
+	}
+	if w.size <= 0 {
+		w.size = DefaultPartSize
+	}
+	conc := opts.Concurrency
+	if conc <= 0 {
+		conc = DefaultConcurrency
+	}
+	w.sem = make(chan struct{}, conc)
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w, nil
+}
+
+// error returns the first error from an upload.
+func (w *Writer) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// setError records the first error, stops the other parts and aborts the
+// upload once they are done.
+func (w *Writer) setError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	w.err = err
+	w.cancel()
+	w.aborted = make(chan struct{})
+	go func() {
+		// no parts are started after the error (see flush).
+		w.wg.Wait()
+		w.abortErr = w.abort()
+		close(w.aborted)
+	}()
+}
+
+// Write implements io.Writer. It returns the first error from the upload of
+// a part, after which the upload is aborted.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("s3seek: write to closed Writer")
+	}
+	n := 0
+	for len(p) > 0 {
+		if err := w.error(); err != nil {
+			return n, err
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.size)
+		}
+		m := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		p = p[m:]
+		if len(w.buf) == w.size {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffer as the next part in the background.
+func (w *Writer) flush() error {
+	if w.uploadID == nil {
+		var co *s3.CreateMultipartUploadOutput
+		err := w.retry.do(w.ctx, func() (err error) {
+			co, err = w.s3.CreateMultipartUploadWithContext(w.ctx, &w.ci)
+			return err
+		})
+		if err != nil {
+			err = errors.Wrap(err, "error creating s3 upload")
+			w.setError(err)
+			return err
+		}
+		w.uploadID = co.UploadId
+	}
+	if w.part == maxParts {
+		err := fmt.Errorf("s3seek: too many parts for upload. use a larger PartSize")
+		w.setError(err)
+		return err
+	}
+	w.part++
+	select {
+	case w.sem <- struct{}{}:
+	case <-w.ctx.Done():
+		return w.error()
+	}
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		<-w.sem
+		return w.err
+	}
+	w.wg.Add(1)
+	w.mu.Unlock()
+	go func(part int64, buf []byte) {
+		defer func() { <-w.sem; w.wg.Done() }()
+		var uo *s3.UploadPartOutput
+		err := w.retry.do(w.ctx, func() (err error) {
+			uo, err = w.s3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{Bucket: w.ci.Bucket, Key: w.ci.Key,
+				UploadId: w.uploadID, PartNumber: aws.Int64(part), Body: bytes.NewReader(buf),
+				ContentLength: aws.Int64(int64(len(buf)))})
+			return err
+		})
+		if err != nil {
+			w.setError(errors.Wrapf(err, "error uploading part %d to s3", part))
+			return
+		}
+		w.mu.Lock()
+		w.parts = append(w.parts, &s3.CompletedPart{ETag: uo.ETag, PartNumber: aws.Int64(part)})
+		w.mu.Unlock()
+	}(w.part, w.buf)
+	w.buf = nil
+	return nil
+}
+
+// Close uploads the last part and completes the upload. If the upload
+// failed, it is aborted and the error is returned.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.error()
+	}
+	w.closed = true
+	// an empty object is uploaded as a single empty part.
+	if w.error() == nil && (len(w.buf) != 0 || w.part == 0) {
+		w.flush()
+	}
+	w.wg.Wait()
+	if err := w.error(); err != nil {
+		<-w.aborted
+		return err
+	}
+	sort.Slice(w.parts, func(i, j int) bool { return *w.parts[i].PartNumber < *w.parts[j].PartNumber })
+	err := w.retry.do(w.ctx, func() error {
+		_, err := w.s3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+			Bucket: w.ci.Bucket, Key: w.ci.Key, UploadId: w.uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: w.parts}})
+		return err
+	})
+	w.cancel()
+	if err != nil {
+		w.setError(errors.Wrap(err, "error completing s3 upload"))
+		<-w.aborted
+	}
+	return w.error()
+}
+
+// Abort the upload. Nothing is written to the object.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return w.error()
+	}
+	w.closed = true
+	w.setError(fmt.Errorf("s3seek: upload aborted"))
+	w.wg.Wait()
+	<-w.aborted
+	return w.abortErr
+}
+
+// abort the multipart upload, if it was created.
+func (w *Writer) abort() error {
+	if w.uploadID == nil {
+		return nil
+	}
+	// w.ctx may be cancelled.
+	ctx := context.Background()
+	err := w.retry.do(ctx, func() error {
+		_, err := w.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket: w.ci.Bucket, Key: w.ci.Key, UploadId: w.uploadID})
+		return err
+	})
+	return errors.Wrap(err, "error aborting s3 upload")
+}
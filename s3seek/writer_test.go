@@ -0,0 +1,77 @@
+package s3seek_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/brentp/go-athenaeum/s3seek"
+	"github.com/brentp/go-athenaeum/s3seek/fakes3"
+)
+
+func TestWriter(t *testing.T) {
+	f := fakes3.New()
+	f.MinPartSize = 1000
+	w, err := s3seek.NewWriter(f, "s3://bucket/out", &s3seek.WriterOptions{PartSize: 1000, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5500)
+	rand.Read(data)
+	for b := data; len(b) > 0; {
+		n := 333
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if _, ok := f.Object("bucket", "out"); ok {
+		t.Fatal("object should not exist before Close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := f.Object("bucket", "out"); !bytes.Equal(b, data) {
+		t.Fatal("wrong data")
+	}
+	if n := f.Requests("UploadPart"); n != 6 {
+		t.Errorf("expected 6 parts, got %d", n)
+	}
+
+	// a failed part aborts the upload.
+	w, _ = s3seek.NewWriter(f, "bucket/failed", &s3seek.WriterOptions{PartSize: 1000, Retry: fastRetry})
+	f.Fail("UploadPart", errors.New("denied"))
+	w.Write(data)
+	if err := w.Close(); err == nil {
+		t.Error("expected error from Close")
+	}
+	if _, ok := f.Object("bucket", "failed"); ok || f.Uploads() != 0 {
+		t.Errorf("expected no object and no uploads, got %d uploads", f.Uploads())
+	}
+
+	// the upload is aborted even if Close is not called after the error.
+	w, _ = s3seek.NewWriter(f, "bucket/failed", &s3seek.WriterOptions{PartSize: 1000, Retry: fastRetry})
+	f.Fail("UploadPart", errors.New("denied"))
+	for err == nil {
+		_, err = w.Write(data)
+	}
+	for start := time.Now(); f.Uploads() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("expected no uploads without Close, got %d", f.Uploads())
+		}
+	}
+
+	w, _ = s3seek.NewWriter(f, "bucket/aborted", &s3seek.WriterOptions{PartSize: 1000})
+	w.Write(data)
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Object("bucket", "aborted"); ok || f.Uploads() != 0 {
+		t.Error("expected no object and no uploads after Abort")
+	}
+}
@@ -0,0 +1,115 @@
+package shpool
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Budget is a CPU budget shared by pools in any number of OS processes on the
+// same machine. It is a directory of token files, one per CPU; a pool holds a
+// lock (flock) on one token for each CPU used by each running process. Since
+// the locks are released by the kernel when a process exits, tokens held by a
+// process that crashes are recovered automatically.
+//
+// A Pool uses a Budget via Options.Budget and will then run a process only
+// when it has enough CPUs of its own and enough tokens in the budget.
+type Budget struct {
+	dir  string
+	cpus int
+	// Interval at which a pool that is waiting only for tokens checks again.
+	Interval time.Duration
+}
+
+// DefaultBudgetDir is used by NewBudget when no directory is given. It is in
+// /dev/shm or, where that does not exist (e.g. on macOS), in os.TempDir().
+var DefaultBudgetDir = filepath.Join(shmDir(), fmt.Sprintf("shpool-%d", os.Getuid()))
+
+func shmDir() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// NewBudget returns a Budget of cpus tokens stored in dir (DefaultBudgetDir if
+// dir is ""). All programs sharing the budget should use the same dir and the
+// same number of cpus, e.g. runtime.NumCPU().
+func NewBudget(dir string, cpus int) (*Budget, error) {
+	if cpus < 1 {
+		return nil, fmt.Errorf("shpool: budget must have at least 1 cpu. got %d", cpus)
+	}
+	if dir == "" {
+		dir = DefaultBudgetDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "[shpool] error creating budget directory")
+	}
+	return &Budget{dir: dir, cpus: cpus, Interval: 500 * time.Millisecond}, nil
+}
+
+// CPUs returns the total number of tokens in the budget.
+func (b *Budget) CPUs() int {
+	return b.cpus
+}
+
+// acquire tries to lock n tokens without blocking. It returns nil if fewer
+// than n tokens are available.
+func (b *Budget) acquire(n int) []*os.File {
+	tokens := make([]*os.File, 0, n)
+	// start at a random token so that pools don't all contend for the first ones.
+	off := rand.Intn(b.cpus)
+	for i := 0; i < b.cpus && len(tokens) < n; i++ {
+		name := filepath.Join(b.dir, fmt.Sprintf("token-%d", (i+off)%b.cpus))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			continue
+		}
+		tokens = append(tokens, f)
+	}
+	if len(tokens) < n {
+		release(tokens)
+		return nil
+	}
+	return tokens
+}
+
+// release returns tokens to the budget.
+func release(tokens []*os.File) {
+	for _, f := range tokens {
+		// closing the file releases the lock.
+		f.Close()
+	}
+}
+
+// pollBudget periodically tries to start waiting processes, since tokens may
+// be released by other programs. It returns when no processes are waiting.
+func (pool *Pool) pollBudget() {
+	t := time.NewTicker(pool.options.Budget.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-pool.ctx.Done():
+		}
+		pool.mu.Lock()
+		if pool.ctx.Err() == nil {
+			pool.sendWaiting()
+		}
+		if len(pool.waitingProcesses) == 0 || pool.ctx.Err() != nil {
+			pool.budgetPolling = false
+			pool.mu.Unlock()
+			return
+		}
+		pool.mu.Unlock()
+	}
+}
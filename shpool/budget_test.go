@@ -0,0 +1,68 @@
+package shpool
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewBudget(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Interval = 20 * time.Millisecond
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each pool could run both processes at once if not for the budget.
+			p := New(2, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, Budget: b})
+			p.Add(Process{Command: "sleep 0.3"})
+			p.Add(Process{Command: "sleep 0.3"})
+			if err := p.Wait(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if time.Since(start) < 600*time.Millisecond {
+		t.Fatal("expected pools to share the budget")
+	}
+	// the pools stop polling the budget once no processes are waiting.
+	p := New(2, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, Budget: b})
+	tokens := b.acquire(2)
+	p.Add(Process{Command: "true"})
+	time.Sleep(2 * b.Interval)
+	p.mu.Lock()
+	polling := p.budgetPolling
+	p.mu.Unlock()
+	release(tokens)
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * b.Interval)
+	p.mu.Lock()
+	if !polling || p.budgetPolling {
+		t.Errorf("expected polling only while waiting for tokens, got %v and %v", polling, p.budgetPolling)
+	}
+	p.mu.Unlock()
+
+	// all tokens should be released.
+	if tokens := b.acquire(2); tokens == nil {
+		t.Fatal("expected tokens to be released")
+	} else {
+		release(tokens)
+	}
+}
@@ -0,0 +1,134 @@
+// Package client submits jobs to a shpool daemon (see the daemon package)
+// over its unix socket.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/brentp/go-athenaeum/shpool/daemon"
+	perrors "github.com/pkg/errors"
+)
+
+// Client talks to the daemon listening on a socket.
+type Client struct {
+	path string
+}
+
+// New returns a Client for the daemon at path (daemon.DefaultSocket if path
+// is ""). No connection is made until a request is sent.
+func New(path string) *Client {
+	if path == "" {
+		path = daemon.DefaultSocket
+	}
+	return &Client{path: path}
+}
+
+// send a request and return a decoder for the responses. The caller must
+// close the connection.
+func (c *Client) send(req daemon.Request) (net.Conn, *json.Decoder, error) {
+	conn, err := net.Dial("unix", c.path)
+	if err != nil {
+		return nil, nil, perrors.Wrap(err, "[shpool] error connecting to daemon")
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, nil, perrors.Wrap(err, "[shpool] error sending request")
+	}
+	return conn, json.NewDecoder(conn), nil
+}
+
+// do sends a request that has a single response.
+func (c *Client) do(req daemon.Request) (*daemon.Response, error) {
+	conn, dec, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return next(dec)
+}
+
+func next(dec *json.Decoder) (*daemon.Response, error) {
+	var resp daemon.Response
+	if err := dec.Decode(&resp); err != nil {
+		return nil, perrors.Wrap(err, "[shpool] error reading response")
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// Submit a job and return its id.
+func (c *Client) Submit(j daemon.Job) (int, error) {
+	resp, err := c.do(daemon.Request{Op: daemon.OpSubmit, Job: &j})
+	if err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+// Status returns the status of the job with the given id.
+func (c *Client) Status(id int) (daemon.Status, error) {
+	resp, err := c.do(daemon.Request{Op: daemon.OpStatus, ID: id})
+	if err != nil {
+		return daemon.Status{}, err
+	}
+	if len(resp.Jobs) != 1 {
+		return daemon.Status{}, errors.New("shpool: bad response from daemon")
+	}
+	return resp.Jobs[0], nil
+}
+
+// Jobs returns the status of all jobs submitted to the daemon.
+func (c *Client) Jobs() ([]daemon.Status, error) {
+	resp, err := c.do(daemon.Request{Op: daemon.OpStatus, ID: -1})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, nil
+}
+
+// Cancel the job with the given id.
+func (c *Client) Cancel(id int) error {
+	_, err := c.do(daemon.Request{Op: daemon.OpCancel, ID: id})
+	return err
+}
+
+// CancelPrefix cancels all jobs with the given prefix and returns how many
+// were cancelled.
+func (c *Client) CancelPrefix(prefix string) (int, error) {
+	resp, err := c.do(daemon.Request{Op: daemon.OpCancel, Prefix: prefix})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Cancelled, nil
+}
+
+// Output writes the output (stdout and stderr) of the job with the given id
+// to w as it is written, until the job finishes. It returns the final status
+// of the job.
+func (c *Client) Output(id int, w io.Writer) (daemon.Status, error) {
+	conn, dec, err := c.send(daemon.Request{Op: daemon.OpOutput, ID: id})
+	if err != nil {
+		return daemon.Status{}, err
+	}
+	defer conn.Close()
+	for {
+		resp, err := next(dec)
+		if err != nil {
+			return daemon.Status{}, err
+		}
+		if resp.Done {
+			if len(resp.Jobs) != 1 {
+				return daemon.Status{}, errors.New("shpool: bad response from daemon")
+			}
+			return resp.Jobs[0], nil
+		}
+		if _, err := w.Write(resp.Output); err != nil {
+			return daemon.Status{}, err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package shpool
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// signal sends sig to the process group of p.
+func (p *process) signal(sig syscall.Signal) error {
+	if p.c == nil || p.c.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-p.c.Process.Pid, sig)
+}
+
+// Signal sends sig to the process groups of the running processes. As these
+// are not in the foreground process group of a terminal, they don't get a
+// SIGINT (e.g. Ctrl-C) or SIGTERM received by the program, so a program that
+// handles these should call Signal (or KillAll) before it exits. See also
+// Options.ForwardSignals.
+func (pool *Pool) Signal(sig syscall.Signal) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, p := range pool.running {
+		p.signal(sig)
+	}
+}
+
+// forwardSignals sends each signal from c to the running processes.
+func (pool *Pool) forwardSignals(c chan os.Signal) {
+	for sig := range c {
+		pool.logger.Printf("forwarding signal: %s", sig)
+		pool.Signal(sig.(syscall.Signal))
+	}
+}
+
+// startTimer starts (or restarts after a pause) the timeout for p.
+// must be called in a lock
+func (p *process) startTimer(pool *Pool) {
+	if p.p.Timeout <= 0 || p.timedOut {
+		return
+	}
+	if p.timer == nil {
+		p.remaining = p.p.Timeout
+	}
+	p.timerStart = time.Now()
+	attempt := p.attempts
+	p.timer = time.AfterFunc(p.remaining, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		if _, ok := pool.running[p.idx]; !ok || p.attempts != attempt {
+			return
+		}
+		p.timedOut = true
+		pool.logger.Printf("timeout (%s) for process: %s", p.p.Timeout, p.p.Prefix)
+		p.signal(syscall.SIGKILL)
+	})
+}
+
+// stopTimer stops the timeout for p, recording the time that remains.
+// must be called in a lock
+func (p *process) stopTimer() {
+	if p.timer != nil && p.timer.Stop() {
+		p.remaining -= time.Since(p.timerStart)
+	}
+}
+
+// Cancel the process with the given id (as returned by Add). A waiting
+// process is removed from the pool and a running process is killed. In either
+// case, the error for the process is ErrCancelled.
+func (pool *Pool) Cancel(id int) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if p, ok := pool.running[id]; ok {
+		pool.cancelRunning(p)
+		return nil
+	}
+	for i, p := range pool.waitingProcesses {
+		if p.idx == id {
+			pool.cancelWaiting(i)
+			if pool.options.KeepOrder {
+				// its output may let others start.
+				pool.sendWaiting()
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("shpool: no waiting or running process with id %d", id)
+}
+
+// CancelPrefix cancels all waiting and running processes with the given
+// Prefix and returns the number of processes that were cancelled.
+func (pool *Pool) CancelPrefix(prefix string) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	n := 0
+	for _, p := range pool.running {
+		if p.p.Prefix == prefix && !p.cancelled {
+			pool.cancelRunning(p)
+			n++
+		}
+	}
+	for i := len(pool.waitingProcesses) - 1; i >= 0; i-- {
+		if pool.waitingProcesses[i].p.Prefix == prefix {
+			pool.cancelWaiting(i)
+			n++
+		}
+	}
+	if pool.options.KeepOrder {
+		// their output may let others start.
+		pool.sendWaiting()
+	}
+	return n
+}
+
+// must be called in a lock
+func (pool *Pool) cancelRunning(p *process) {
+	p.cancelled = true
+	pool.logger.Printf("cancelling process: %s", p.p.Prefix)
+	p.signal(syscall.SIGKILL)
+}
+
+// must be called in a lock
+func (pool *Pool) cancelWaiting(i int) {
+	p := pool.waitingProcesses[i]
+	pool.waitingProcesses = append(pool.waitingProcesses[:i], pool.waitingProcesses[i+1:]...)
+	p.cancelled = true
+	p.err = ErrCancelled
+	pool.logger.Printf("cancelled waiting process: %s", p.p.Prefix)
+	pool.done(p)
+	pool.emit(p)
+	pool.forget(p)
+}
+
+// Pause stops launching new processes and sends SIGSTOP to all running
+// processes. Time spent paused does not count toward a process's Timeout.
+func (pool *Pool) Pause() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.paused {
+		return
+	}
+	pool.paused = true
+	for _, p := range pool.running {
+		p.stopTimer()
+		if err := p.signal(syscall.SIGSTOP); err != nil {
+			pool.logger.Printf("error pausing process: %s -> %s", p.p.Prefix, err)
+		}
+	}
+}
+
+// Resume sends SIGCONT to all processes stopped by Pause and starts launching
+// new processes again.
+func (pool *Pool) Resume() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if !pool.paused {
+		return
+	}
+	pool.paused = false
+	for _, p := range pool.running {
+		if err := p.signal(syscall.SIGCONT); err != nil {
+			pool.logger.Printf("error resuming process: %s -> %s", p.p.Prefix, err)
+		}
+		p.startTimer(pool)
+	}
+	pool.sendWaiting()
+}
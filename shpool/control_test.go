@@ -0,0 +1,148 @@
+package shpool
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func quietPool(cpus int) *Pool {
+	return New(cpus, log.New(ioutil.Discard, "", 0), &Options{Quiet: true})
+}
+
+func TestCancel(t *testing.T) {
+	p := quietPool(1)
+	running := p.Add(Process{Command: "sleep 10", Prefix: "running"})
+	waiting := p.Add(Process{Command: "sleep 10", Prefix: "waiting"})
+	if err := p.Cancel(waiting); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cancel(running); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cancel(1000); err == nil {
+		t.Fatal("expected error for unknown id")
+	}
+	start := time.Now()
+	if err := p.Wait(); err == nil {
+		t.Fatal("expected error from cancelled processes")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected cancelled processes to be killed")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Command: "sleep 10; true", Prefix: "a"})
+	p.Add(Process{Command: "sleep 10; true", Prefix: "b"})
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	p.Signal(syscall.SIGTERM)
+	var es Errors
+	if err := p.Wait(); !errors.As(err, &es) || len(es) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+	for _, e := range es {
+		if e.Signal != syscall.SIGTERM {
+			t.Errorf("expected SIGTERM for %s, got %+v", e.Prefix, e)
+		}
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected the signal to stop the children of the processes")
+	}
+}
+
+func TestCancelPrefix(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Command: "sleep 10", Prefix: "a"})
+	p.Add(Process{Command: "sleep 10", Prefix: "a"})
+	p.Add(Process{Command: "sleep 10", Prefix: "a"})
+	p.Add(Process{Command: "true", Prefix: "b"})
+	if n := p.CancelPrefix("a"); n != 3 {
+		t.Fatalf("expected 3 cancelled processes, got %d", n)
+	}
+	p.Wait()
+}
+
+func TestPauseTimeout(t *testing.T) {
+	p := quietPool(1)
+	start := time.Now()
+	p.Add(Process{Command: "sleep 10", Timeout: 300 * time.Millisecond})
+	p.Pause()
+	time.Sleep(500 * time.Millisecond)
+	p.Resume()
+	if err := p.Wait(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+	if time.Since(start) < 700*time.Millisecond {
+		t.Fatal("expected paused time to be excluded from timeout")
+	}
+
+	p = quietPool(1)
+	p.Add(Process{Command: "for i in 1 2 3; do sleep 0.1; done", Timeout: 500 * time.Millisecond})
+	time.Sleep(100 * time.Millisecond)
+	p.Pause()
+	time.Sleep(600 * time.Millisecond)
+	p.Resume()
+	if err := p.Wait(); err != nil {
+		t.Fatalf("expected paused time to be excluded from timeout, got: %v", err)
+	}
+}
+
+func TestPauseWaiting(t *testing.T) {
+	p := quietPool(1)
+	p.Pause()
+	p.Add(Process{Command: "true"})
+	p.mu.Lock()
+	n := len(p.running)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expected no processes to start while paused")
+	}
+	p.Resume()
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateAndOnFinish(t *testing.T) {
+	finished := make(chan Result, 2)
+	p := New(1, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, OnFinish: func(r Result) { finished <- r }})
+	var out, errs syncBuffer
+	running := p.Add(Process{Command: "sleep 0.2; echo $X; echo err >&2", Env: []string{"X=env"}, Stdout: &out, Stderr: &errs})
+	waiting := p.Add(Process{Command: "true"})
+	if s := p.State(running); s != Running {
+		t.Errorf("expected running, got %s", s)
+	}
+	if s := p.State(waiting); s != Waiting {
+		t.Errorf("expected waiting, got %s", s)
+	}
+	if s := p.State(99); s != Unknown {
+		t.Errorf("expected unknown, got %s", s)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.State(running); s != Finished {
+		t.Errorf("expected finished, got %s", s)
+	}
+	if out.String() != "env\n" || errs.String() != "err\n" {
+		t.Errorf("unexpected output: %q %q", out.String(), errs.String())
+	}
+	ids := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-finished:
+			ids[r.ID] = true
+		case <-time.After(time.Second):
+			t.Fatal("OnFinish not called")
+		}
+	}
+	if !ids[running] || !ids[waiting] {
+		t.Errorf("unexpected OnFinish ids: %v", ids)
+	}
+}
@@ -0,0 +1,456 @@
+// Package daemon runs a shpool.Pool that accepts jobs from other programs
+// over a unix domain socket. See the client package for submitting jobs.
+//
+// The protocol is one JSON Request per connection followed by one or more
+// JSON Responses from the daemon, each on its own line.
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brentp/go-athenaeum/shpool"
+	"github.com/pkg/errors"
+)
+
+// DefaultSocket is used by Listen and by the client when no path is given.
+// It is in $XDG_RUNTIME_DIR or, if that is not set, in a directory in
+// os.TempDir() that Listen creates and that only the user may use.
+var DefaultSocket = defaultSocket()
+
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "shpool.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("shpool-%d", os.Getuid()), "shpool.sock")
+}
+
+// privateDir creates dir if needed and checks that only the user may use it.
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "[shpool] error creating socket directory")
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return errors.Wrap(err, "[shpool] error checking socket directory")
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() || fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("shpool: %s must be a directory that only the user may use", dir)
+	}
+	return nil
+}
+
+// DefaultMaxOutput is the number of bytes of output kept for each job.
+const DefaultMaxOutput = 1 << 20
+
+// DefaultMaxJobs is the number of finished jobs kept by a Server.
+const DefaultMaxJobs = 1000
+
+// Ops of a Request.
+const (
+	OpSubmit = "submit"
+	OpStatus = "status"
+	OpCancel = "cancel"
+	OpOutput = "output"
+)
+
+// Job is a command to run in the pool of the daemon.
+type Job struct {
+	Command string
+	// CPUs used by the command. Default is 1.
+	CPUs   int
+	Prefix string
+	// Env holds extra environment variables for the command as "KEY=value".
+	Env []string
+}
+
+// Request is sent by a client.
+type Request struct {
+	// Op is one of OpSubmit, OpStatus, OpCancel or OpOutput.
+	Op  string
+	Job *Job `json:",omitempty"`
+	// ID of the job for OpStatus, OpCancel and OpOutput. For OpStatus, -1
+	// gets all jobs.
+	ID int
+	// Prefix, if given for OpCancel, cancels all jobs with the Prefix instead of ID.
+	Prefix string `json:",omitempty"`
+}
+
+// Status of a job.
+type Status struct {
+	ID      int
+	Prefix  string
+	Command string
+	CPUs    int
+	// State is "waiting", "running" or "finished".
+	State string
+	// ExitCode, Error, Start and Duration are set when the job is finished.
+	ExitCode int
+	Error    string `json:",omitempty"`
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Response is sent by the daemon. An OpOutput request gets a Response for
+// each chunk of output and a last one with Done set and the Status of the job.
+type Response struct {
+	Error string `json:",omitempty"`
+	// ID of a submitted job.
+	ID int
+	// Cancelled is the number of jobs that were cancelled.
+	Cancelled int      `json:",omitempty"`
+	Jobs      []Status `json:",omitempty"`
+	// Output is the combined stdout and stderr of a job.
+	Output []byte `json:",omitempty"`
+	Done   bool   `json:",omitempty"`
+}
+
+// job holds the output of a submitted job.
+type job struct {
+	status Status
+	max    int
+
+	mu  sync.Mutex
+	out []byte
+	// number of bytes dropped from the start of out.
+	dropped int
+	// closed and replaced when output is written or the job finishes.
+	changed  chan struct{}
+	finished bool
+}
+
+// Write is used for both stdout and stderr of the job.
+func (j *job) Write(b []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.out = append(j.out, b...)
+	if len(j.out) > j.max {
+		// keep the end of the output.
+		n := len(j.out) - j.max
+		j.out = append(j.out[:0], j.out[n:]...)
+		j.dropped += n
+	}
+	j.notify()
+	return len(b), nil
+}
+
+// must be called with j.mu held.
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Server wraps a shpool.Pool and runs the jobs submitted to its socket.
+type Server struct {
+	pool   *shpool.Pool
+	ln     net.Listener
+	path   string
+	logger *log.Logger
+	// MaxOutput is the number of bytes of output kept for each job.
+	MaxOutput int
+	// MaxJobs is the number of finished jobs kept. Older finished jobs are
+	// forgotten, along with their output.
+	MaxJobs int
+
+	mu   sync.Mutex
+	jobs map[int]*job
+	// ids of the finished jobs in the order they finished.
+	finished []int
+	closing  chan struct{}
+	conns    sync.WaitGroup
+	// open connections.
+	open map[net.Conn]bool
+}
+
+// Listen creates a pool (see shpool.New; opts may be nil) and listens on the unix socket at
+// path (DefaultSocket if path is ""). A stale socket left by a daemon that
+// exited is removed but any other file at path is an error. Only the user
+// may connect to the socket. The pool doesn't keep the results of the jobs
+// (see shpool.Options.DiscardResults). Call Serve to accept jobs.
+func Listen(path string, cpus int, logger *log.Logger, opts *shpool.Options) (*Server, error) {
+	if path == "" {
+		path = DefaultSocket
+		if err := privateDir(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("shpool: %s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("shpool: daemon already listening on %s", path)
+		}
+		os.Remove(path)
+	}
+	// the socket is created with mode 0600 so that no one else can connect
+	// before its permissions are set.
+	mask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, errors.Wrap(err, "[shpool] error listening")
+	}
+	if logger == nil {
+		logger = log.New(os.Stderr, "shpool: ", log.Ldate|log.Ltime)
+	}
+	s := &Server{ln: ln, path: path, logger: logger, MaxOutput: DefaultMaxOutput, MaxJobs: DefaultMaxJobs,
+		jobs: make(map[int]*job), closing: make(chan struct{}), open: make(map[net.Conn]bool)}
+	var o shpool.Options
+	if opts != nil {
+		o = *opts
+	}
+	// the jobs are kept by the server up to MaxJobs.
+	o.DiscardResults = true
+	f := o.OnFinish
+	o.OnFinish = func(r shpool.Result) {
+		s.finish(r)
+		if f != nil {
+			f(r)
+		}
+	}
+	s.pool = shpool.New(cpus, logger, &o)
+	return s, nil
+}
+
+// Pool returns the pool that runs the jobs.
+func (s *Server) Pool() *shpool.Pool {
+	return s.pool
+}
+
+// Serve accepts connections until Close is called.
+func (s *Server) Serve() error {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closing:
+				return nil
+			default:
+			}
+			return errors.Wrap(err, "[shpool] error accepting connection")
+		}
+		s.conns.Add(1)
+		s.track(c)
+		go func() {
+			defer s.conns.Done()
+			defer s.untrack(c)
+			if err := s.handle(c); err != nil {
+				s.logger.Printf("error handling request: %s", err)
+			}
+		}()
+	}
+}
+
+// track adds c to the open connections. Reads from connections fail once
+// the server is closing so that Close does not wait for idle clients.
+func (s *Server) track(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[c] = true
+	select {
+	case <-s.closing:
+		c.SetReadDeadline(time.Now())
+	default:
+	}
+}
+
+func (s *Server) untrack(c net.Conn) {
+	s.mu.Lock()
+	delete(s.open, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+// Close stops accepting jobs, kills all jobs in the pool, waits for it and
+// removes the socket. The errors of the jobs are only in their Status.
+func (s *Server) Close() error {
+	close(s.closing)
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.open {
+		// stop reading requests. responses are still written.
+		c.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+	s.pool.KillAll()
+	err := s.pool.Wait()
+	s.conns.Wait()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) handle(c net.Conn) error {
+	var req Request
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		return errors.Wrap(err, "[shpool] error decoding request")
+	}
+	enc := json.NewEncoder(c)
+	var resp Response
+	var err error
+	switch req.Op {
+	case OpSubmit:
+		resp.ID, err = s.submit(req.Job)
+	case OpStatus:
+		resp.Jobs, err = s.statuses(req.ID)
+	case OpCancel:
+		if req.Prefix != "" {
+			resp.Cancelled = s.pool.CancelPrefix(req.Prefix)
+		} else if err = s.pool.Cancel(req.ID); err == nil {
+			resp.Cancelled = 1
+		}
+	case OpOutput:
+		s.mu.Lock()
+		j, ok := s.jobs[req.ID]
+		s.mu.Unlock()
+		if ok {
+			return s.output(enc, j)
+		}
+		err = fmt.Errorf("shpool: no job with id %d", req.ID)
+	default:
+		err = fmt.Errorf("shpool: unknown op: %q", req.Op)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return enc.Encode(resp)
+}
+
+func (s *Server) submit(j *Job) (id int, err error) {
+	if j == nil || j.Command == "" {
+		return 0, fmt.Errorf("shpool: no command to submit")
+	}
+	select {
+	case <-s.closing:
+		return 0, fmt.Errorf("shpool: daemon is closing")
+	default:
+	}
+	jb := &job{max: s.MaxOutput, changed: make(chan struct{}),
+		status: Status{Prefix: j.Prefix, Command: j.Command, CPUs: j.CPUs}}
+	if jb.status.CPUs == 0 {
+		jb.status.CPUs = 1
+	}
+	defer func() {
+		// Add panics for a process it can not run.
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	// hold the lock until the job is recorded since it may finish before Add returns.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id = s.pool.Add(shpool.Process{Command: j.Command, CPUs: j.CPUs, Prefix: j.Prefix, Env: j.Env,
+		Stdout: jb, Stderr: jb})
+	jb.status.ID = id
+	s.jobs[id] = jb
+	return id, nil
+}
+
+// finish is called by the pool for each finished job. It forgets the oldest
+// finished jobs beyond MaxJobs.
+func (s *Server) finish(r shpool.Result) {
+	s.mu.Lock()
+	j, ok := s.jobs[r.ID]
+	if ok {
+		s.finished = append(s.finished, r.ID)
+		for len(s.finished) > s.MaxJobs {
+			delete(s.jobs, s.finished[0])
+			s.finished = s.finished[1:]
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	j.mu.Lock()
+	j.status.ExitCode, j.status.Start, j.status.Duration = r.ExitCode, r.Start, r.Duration
+	if r.Err != nil {
+		j.status.Error = r.Err.Error()
+	}
+	j.finished = true
+	j.notify()
+	j.mu.Unlock()
+}
+
+// status returns the Status of j.
+func (s *Server) status(j *job) Status {
+	j.mu.Lock()
+	st, finished := j.status, j.finished
+	j.mu.Unlock()
+	if finished {
+		// the pool may not have called finish yet so its State is not used.
+		st.State = shpool.Finished.String()
+	} else if state := s.pool.State(st.ID); state == shpool.Finished {
+		st.State = shpool.Running.String()
+	} else {
+		st.State = state.String()
+	}
+	return st
+}
+
+// statuses returns the Status of the job with id or of all jobs if id is -1.
+func (s *Server) statuses(id int) ([]Status, error) {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		if id == -1 || j.status.ID == id {
+			jobs = append(jobs, j)
+		}
+	}
+	s.mu.Unlock()
+	if len(jobs) == 0 && id != -1 {
+		return nil, fmt.Errorf("shpool: no job with id %d", id)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].status.ID < jobs[k].status.ID })
+	sts := make([]Status, len(jobs))
+	for i, j := range jobs {
+		sts[i] = s.status(j)
+	}
+	return sts, nil
+}
+
+// output streams the output of j until it finishes. Output that was dropped
+// because of MaxOutput is skipped.
+func (s *Server) output(enc *json.Encoder, j *job) error {
+	const chunk = 32768
+	off := 0
+	for {
+		j.mu.Lock()
+		if off < j.dropped {
+			off = j.dropped
+		}
+		b := j.out[off-j.dropped:]
+		if len(b) > chunk {
+			b = b[:chunk]
+		}
+		b = append([]byte(nil), b...)
+		changed, finished := j.changed, j.finished
+		j.mu.Unlock()
+
+		if len(b) != 0 {
+			if err := enc.Encode(Response{ID: j.status.ID, Output: b}); err != nil {
+				return err
+			}
+			off += len(b)
+			continue
+		}
+		if finished {
+			return enc.Encode(Response{ID: j.status.ID, Done: true, Jobs: []Status{s.status(j)}})
+		}
+		select {
+		case <-changed:
+		case <-s.closing:
+			return enc.Encode(Response{ID: j.status.ID, Error: "shpool: daemon is closing"})
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package daemon_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentp/go-athenaeum/shpool"
+	"github.com/brentp/go-athenaeum/shpool/client"
+	"github.com/brentp/go-athenaeum/shpool/daemon"
+)
+
+func serve(t *testing.T, cpus int) (*daemon.Server, *client.Client, string) {
+	dir, err := ioutil.TempDir("", "shpool-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sock")
+	s, err := daemon.Listen(path, cpus, log.New(ioutil.Discard, "", 0), &shpool.Options{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	return s, client.New(path), path
+}
+
+func TestListenNotSocket(t *testing.T) {
+	f, err := ioutil.TempFile("", "shpool-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, err := daemon.Listen(f.Name(), 1, nil, nil); err == nil {
+		t.Fatal("expected error for a path that is not a socket")
+	}
+	if _, err := os.Stat(f.Name()); err != nil {
+		t.Fatalf("expected file to be kept: %s", err)
+	}
+}
+
+func TestListenDefault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { daemon.DefaultSocket = path }(daemon.DefaultSocket)
+	daemon.DefaultSocket = filepath.Join(dir, "private", "sock")
+	s, err := daemon.Listen("", 1, log.New(ioutil.Discard, "", 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, mode := range map[string]os.FileMode{filepath.Join(dir, "private"): 0700, daemon.DefaultSocket: 0600} {
+		if fi, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != mode {
+			t.Errorf("expected mode %s for %s, got %s", mode, path, fi.Mode().Perm())
+		}
+	}
+	s.Close()
+
+	// a directory that others may use is an error.
+	if err := os.Chmod(filepath.Join(dir, "private"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := daemon.Listen("", 1, nil, nil); err == nil {
+		t.Error("expected error for a socket directory that others may use")
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	s, c, path := serve(t, 2)
+	id, err := c.Submit(daemon.Job{Command: "echo $X; sleep 0.2; echo done", Prefix: "echo", Env: []string{"X=hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	st, err := c.Output(id, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello\ndone\n" {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+	if st.State != "finished" || st.ExitCode != 0 || st.Error != "" {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	// output of a finished job is kept.
+	out.Reset()
+	if _, err := c.Output(id, &out); err != nil || out.String() != "hello\ndone\n" {
+		t.Errorf("unexpected output after finish: %q %v", out.String(), err)
+	}
+
+	id, err = c.Submit(daemon.Job{Command: "sleep 10", Prefix: "sleep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if st, _ = c.Status(id); st.State == "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.State != "running" {
+		t.Fatalf("expected running job, got %+v", st)
+	}
+	if err := c.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	st, err = c.Output(id, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(st.Error, "cancelled") {
+		t.Errorf("expected cancelled job, got %+v", st)
+	}
+
+	if _, err := c.Submit(daemon.Job{Command: "true", CPUs: 3}); err == nil {
+		t.Error("expected error for too many cpus")
+	}
+	if _, err := c.Status(99); err == nil {
+		t.Error("expected error for unknown job")
+	}
+	jobs, err := c.Jobs()
+	if err != nil || len(jobs) != 2 || jobs[0].ID != 0 || jobs[1].ID != 1 {
+		t.Errorf("unexpected jobs: %+v %v", jobs, err)
+	}
+
+	// only the last MaxJobs finished jobs are kept.
+	s.MaxJobs = 1
+	id, err = c.Submit(daemon.Job{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Output(id, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Status(0); err == nil {
+		t.Error("expected old finished job to be forgotten")
+	}
+	if jobs, err := c.Jobs(); err != nil || len(jobs) != 1 || jobs[0].ID != id {
+		t.Errorf("unexpected jobs: %+v %v", jobs, err)
+	}
+	// an idle client does not stop Close.
+	idle, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	// let the server accept it.
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	if n := len(s.Pool().Results()); n != 0 {
+		t.Errorf("expected the pool to keep no results, got %d", n)
+	}
+	if _, err := c.Jobs(); err == nil {
+		t.Error("expected error after close")
+	}
+}
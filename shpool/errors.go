@@ -0,0 +1,88 @@
+package shpool
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// ErrCancelled is the error for a process that was cancelled with Cancel,
+// CancelPrefix or KillAll.
+var ErrCancelled = errors.New("shpool: process cancelled")
+
+// ErrTimeout is the error for a process that ran for longer than its Timeout.
+// See also ErrStalled.
+var ErrTimeout = errors.New("shpool: process timed out")
+
+// ErrNotStarted is the error for a process that was still waiting when the
+// pool was killed by KillAll or StopOnError so it was never run (or retried).
+var ErrNotStarted = errors.New("shpool: process not started")
+
+// ProcessError describes a process that failed. Use errors.Is to check for
+// ErrTimeout, ErrCancelled or ErrNotStarted.
+type ProcessError struct {
+	// ID of the process as returned by Add.
+	ID      int
+	Prefix  string
+	Command string
+	// ExitCode of the command or -1 if it did not exit normally.
+	ExitCode int
+	// Signal that killed the command, if any.
+	Signal syscall.Signal
+	// Attempts is the number of times the command was run.
+	Attempts int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ProcessError) Error() string {
+	cmd := e.Command
+	if len(cmd) > 100 {
+		cmd = cmd[0:100]
+	}
+	return fmt.Sprintf("shpool: process %s (%s): %s", e.Prefix, cmd, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ProcessError) Unwrap() error {
+	return e.Err
+}
+
+// Errors is returned by Pool.Wait and holds one *ProcessError for each
+// process that failed.
+type Errors []*ProcessError
+
+func (es Errors) Error() string {
+	if len(es) == 1 {
+		return es[0].Error()
+	}
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = "\t" + e.Error()
+	}
+	return fmt.Sprintf("shpool: %d processes failed:\n%s", len(es), strings.Join(msgs, "\n"))
+}
+
+// Unwrap allows errors.Is and errors.As to check each *ProcessError. This
+// requires Go 1.20 or later; with earlier versions, range over the Errors.
+func (es Errors) Unwrap() []error {
+	errs := make([]error, len(es))
+	for i, e := range es {
+		errs[i] = e
+	}
+	return errs
+}
+
+// newProcessError returns a *ProcessError for p, which must have an error.
+func newProcessError(p *process) *ProcessError {
+	e := &ProcessError{ID: p.idx, Prefix: p.p.Prefix, Command: p.command(), ExitCode: -1, Err: p.err}
+	e.Attempts = p.attempts
+	if p.c != nil && p.c.ProcessState != nil {
+		e.ExitCode = p.c.ProcessState.ExitCode()
+		if ws, ok := p.c.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			e.Signal = ws.Signal()
+		}
+	}
+	return e
+}
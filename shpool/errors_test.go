@@ -0,0 +1,65 @@
+package shpool
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Command: "exit 3", Prefix: "three"})
+	p.Add(Process{Command: "kill -TERM $$", Prefix: "term"})
+	p.Add(Process{Command: "true", Prefix: "ok"})
+	err := p.Wait()
+	var es Errors
+	if !errors.As(err, &es) {
+		t.Fatalf("expected Errors, got %T", err)
+	}
+	if len(es) != 2 {
+		t.Fatalf("expected 2 errors, got %d", len(es))
+	}
+	byPrefix := map[string]*ProcessError{}
+	for _, e := range es {
+		byPrefix[e.Prefix] = e
+	}
+	if e := byPrefix["three"]; e == nil || e.ExitCode != 3 || e.Attempts != 1 || e.Command != "exit 3" {
+		t.Errorf("unexpected error for exit 3: %+v", e)
+	}
+	if e := byPrefix["term"]; e == nil || e.Signal != syscall.SIGTERM {
+		t.Errorf("unexpected error for kill: %+v", e)
+	}
+	var pe *ProcessError
+	if !errors.As(err, &pe) {
+		t.Fatal("expected errors.As to find a *ProcessError")
+	}
+	if !strings.Contains(err.Error(), "2 processes failed") {
+		t.Errorf("unexpected message: %s", err)
+	}
+}
+
+func TestStopOnError(t *testing.T) {
+	p := New(2, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, StopOnError: true})
+	p.Add(Process{Command: "sleep 10", Prefix: "sleep"})
+	p.Add(Process{Command: "exit 1", Prefix: "fail"})
+	p.Add(Process{Command: "sleep 10", Prefix: "waiting"})
+	err := p.Wait()
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("expected the sleeping process to be cancelled, got: %v", err)
+	}
+	// the waiting process is reported as not started.
+	var es Errors
+	errors.As(err, &es)
+	found := false
+	for _, e := range es {
+		if e.Prefix == "waiting" {
+			found = errors.Is(e, ErrNotStarted) && e.Attempts == 0
+		}
+	}
+	if !found {
+		t.Errorf("expected ErrNotStarted for the waiting process, got: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package shpool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Group sets CPU limits for the processes that belong to it. See
+// Options.Groups and Process.Group.
+type Group struct {
+	// MaxCPUs is the most CPUs that the processes in the group may use at
+	// once. 0 means that only the pool limit applies.
+	MaxCPUs int
+	// MinCPUs are reserved for the group while it has waiting processes;
+	// processes outside the group will not be started if they would use them.
+	// The minimums of sub-groups add up to a minimum for their parent.
+	MinCPUs int
+}
+
+// ancestors returns the group and its parents, e.g. a/b/c, a/b, a.
+func ancestors(group string) []string {
+	if group == "" {
+		return nil
+	}
+	groups := []string{group}
+	for {
+		i := strings.LastIndexByte(group, '/')
+		if i == -1 {
+			return groups
+		}
+		group = group[:i]
+		groups = append(groups, group)
+	}
+}
+
+// validateGroups checks that the groups are possible in a pool with cpus.
+func validateGroups(cpus int, groups map[string]Group) error {
+	children := make(map[string][]string)
+	seen := make(map[string]bool)
+	for name, g := range groups {
+		if g.MaxCPUs < 0 || g.MinCPUs < 0 {
+			return fmt.Errorf("shpool: group %s has negative cpus", name)
+		}
+		if g.MaxCPUs > 0 && g.MinCPUs > g.MaxCPUs {
+			return fmt.Errorf("shpool: group %s has MinCPUs greater than MaxCPUs", name)
+		}
+		// add the group and its parents, which need not be given, to the tree.
+		a := ancestors(name)
+		for i, n := range a {
+			if seen[n] {
+				break
+			}
+			seen[n] = true
+			parent := ""
+			if i+1 < len(a) {
+				parent = a[i+1]
+			}
+			children[parent] = append(children[parent], n)
+		}
+	}
+	// the minimum of a group is at least the sum of the minimums of its sub-groups.
+	var minimum func(name string) (int, error)
+	minimum = func(name string) (int, error) {
+		sum := 0
+		for _, c := range children[name] {
+			m, err := minimum(c)
+			if err != nil {
+				return 0, err
+			}
+			sum += m
+		}
+		g := groups[name]
+		if g.MaxCPUs > 0 && sum > g.MaxCPUs {
+			return 0, fmt.Errorf("shpool: total MinCPUs of sub-groups of %s (%d) is greater than its MaxCPUs (%d)", name, sum, g.MaxCPUs)
+		}
+		if g.MinCPUs > sum {
+			sum = g.MinCPUs
+		}
+		return sum, nil
+	}
+	min, err := minimum("")
+	if err != nil {
+		return err
+	}
+	if min > cpus {
+		return fmt.Errorf("shpool: total MinCPUs of groups (%d) is greater than the pool (%d)", min, cpus)
+	}
+	return nil
+}
+
+// groupMax returns the smallest MaxCPUs of the groups of p (or 0 for none).
+func groupMax(p Process, groups map[string]Group) int {
+	max := 0
+	for _, name := range ancestors(p.Group) {
+		if g := groups[name]; g.MaxCPUs > 0 && (max == 0 || g.MaxCPUs < max) {
+			max = g.MaxCPUs
+		}
+	}
+	return max
+}
+
+// groupState tracks the CPUs used by and the processes waiting in each group
+// while choosing processes to start.
+type groupState struct {
+	groups  map[string]Group
+	used    map[string]int
+	waiting map[string]int
+}
+
+func newGroupState(groups map[string]Group, running, waiting []*process) *groupState {
+	if len(groups) == 0 {
+		return nil
+	}
+	gs := &groupState{groups: groups, used: make(map[string]int), waiting: make(map[string]int)}
+	for _, p := range running {
+		for _, name := range ancestors(p.p.Group) {
+			gs.used[name] += p.p.CPUs
+		}
+	}
+	for _, p := range waiting {
+		for _, name := range ancestors(p.p.Group) {
+			gs.waiting[name]++
+		}
+	}
+	return gs
+}
+
+// fits returns whether p can be started with available cpus without going
+// over the MaxCPUs of its groups or into the MinCPUs of other groups.
+func (gs *groupState) fits(p *process, available int) bool {
+	mine := ancestors(p.p.Group)
+	for _, name := range mine {
+		if g := gs.groups[name]; g.MaxCPUs > 0 && gs.used[name]+p.p.CPUs > g.MaxCPUs {
+			return false
+		}
+	}
+	return p.p.CPUs <= available-gs.reserved(mine)
+}
+
+// reserved returns the cpus held back for the MinCPUs of groups other than
+// mine. A group with waiting processes reserves the cpus it is short of its
+// minimum. The minimums of sub-groups are part of that of their parent, so a
+// group reserves the larger of its own shortfall and the total reserved by
+// its sub-groups.
+func (gs *groupState) reserved(mine []string) int {
+	children := make(map[string]map[string]bool)
+	top := make(map[string]bool)
+	for name := range gs.groups {
+		as := ancestors(name)
+		for i := 0; i < len(as)-1; i++ {
+			if children[as[i+1]] == nil {
+				children[as[i+1]] = make(map[string]bool)
+			}
+			children[as[i+1]][as[i]] = true
+		}
+		top[as[len(as)-1]] = true
+	}
+	var reserve func(name string) int
+	reserve = func(name string) int {
+		r := 0
+		for c := range children[name] {
+			r += reserve(c)
+		}
+		g := gs.groups[name]
+		if g.MinCPUs > 0 && gs.waiting[name] > 0 && !contains(mine, name) && g.MinCPUs-gs.used[name] > r {
+			r = g.MinCPUs - gs.used[name]
+		}
+		return r
+	}
+	reserved := 0
+	for name := range top {
+		reserved += reserve(name)
+	}
+	return reserved
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// start records that p was chosen to start.
+func (gs *groupState) start(p *process) {
+	for _, name := range ancestors(p.p.Group) {
+		gs.used[name] += p.p.CPUs
+		gs.waiting[name]--
+	}
+}
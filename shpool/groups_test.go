@@ -0,0 +1,114 @@
+package shpool
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAncestors(t *testing.T) {
+	if got := ancestors("a/b/c"); !reflect.DeepEqual(got, []string{"a/b/c", "a/b", "a"}) {
+		t.Errorf("unexpected ancestors: %v", got)
+	}
+	if got := ancestors(""); got != nil {
+		t.Errorf("expected no ancestors, got: %v", got)
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	if err := validateGroups(8, map[string]Group{"a": {MinCPUs: 6}, "b": {MinCPUs: 4}}); err == nil {
+		t.Error("expected error for minimums over the pool")
+	}
+	if err := validateGroups(8, map[string]Group{"a": {MinCPUs: 6, MaxCPUs: 4}}); err == nil {
+		t.Error("expected error for min over max")
+	}
+	if err := validateGroups(8, map[string]Group{"a": {MinCPUs: 6}, "a/b": {MinCPUs: 4}, "c": {MinCPUs: 2}}); err != nil {
+		t.Error(err)
+	}
+	// the minimums of sub-groups add up even if their parent has none.
+	if err := validateGroups(4, map[string]Group{"x/b": {MinCPUs: 3}, "x/c": {MinCPUs: 3}}); err == nil {
+		t.Error("expected error for nested minimums over the pool")
+	}
+	if err := validateGroups(8, map[string]Group{"x": {MinCPUs: 2}, "x/b": {MinCPUs: 3}, "x/c": {MinCPUs: 3}, "y/z": {MinCPUs: 2}}); err != nil {
+		t.Error(err)
+	}
+	if err := validateGroups(8, map[string]Group{"x": {MaxCPUs: 4}, "x/b": {MinCPUs: 3}, "x/c": {MinCPUs: 3}}); err == nil {
+		t.Error("expected error for nested minimums over the max of the parent")
+	}
+}
+
+func TestGroupMax(t *testing.T) {
+	procs := make([]Process, 8)
+	for i := range procs {
+		procs[i] = Process{Group: "align", CPUs: 2}
+	}
+	est := func(p Process) time.Duration { return time.Second }
+	sim, err := Simulate(8, procs, est, &Options{Groups: map[string]Group{"align": {MaxCPUs: 4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only 2 processes at a time.
+	if sim.Makespan != 4*time.Second {
+		t.Errorf("expected makespan of 4s with group max, got %s", sim.Makespan)
+	}
+	if _, err := Simulate(8, []Process{{Group: "align", CPUs: 6}}, est, &Options{Groups: map[string]Group{"align": {MaxCPUs: 4}}}); err == nil {
+		t.Error("expected error for process larger than its group")
+	}
+}
+
+func TestGroupMin(t *testing.T) {
+	procs := []Process{
+		{Group: "align", CPUs: 2, Prefix: "a1"},
+		{Group: "align", CPUs: 2, Prefix: "a2"},
+		{Group: "align", CPUs: 2, Prefix: "a3"},
+		{Group: "qc", CPUs: 1, Prefix: "q1"},
+		{Group: "qc", CPUs: 1, Prefix: "q2"},
+	}
+	est := func(p Process) time.Duration {
+		if p.Group == "qc" {
+			return time.Second
+		}
+		return 10 * time.Second
+	}
+	sim, err := Simulate(4, procs, est, &Options{Groups: map[string]Group{"qc": {MinCPUs: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a1 runs but a2 would take the cpu reserved for qc, so q1 and q2 run and
+	// a2 starts when they finish.
+	exp := []time.Duration{0, time.Second, 10 * time.Second, 0, 0}
+	if !reflect.DeepEqual(sim.Starts, exp) {
+		t.Errorf("expected starts %v, got %v", exp, sim.Starts)
+	}
+}
+
+func TestGroupMinNested(t *testing.T) {
+	groups := map[string]Group{"a": {MinCPUs: 2}, "a/c": {MinCPUs: 2}}
+	running := []*process{{p: Process{Group: "a/b", CPUs: 2}}}
+	ac := &process{p: Process{Group: "a/c", CPUs: 2}}
+	ab := &process{p: Process{Group: "a/b", CPUs: 2}}
+	other := &process{p: Process{CPUs: 2}}
+	gs := newGroupState(groups, running, []*process{ac, ab, other})
+	// a/b covers the minimum of a but the 2 cpus left are still reserved for a/c.
+	if gs.fits(other, 2) || gs.fits(ab, 2) {
+		t.Error("expected the minimum of a/c to be reserved")
+	}
+	if !gs.fits(ac, 2) {
+		t.Error("expected a/c to use its reserved cpus")
+	}
+}
+
+func TestPoolGroups(t *testing.T) {
+	p := New(4, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, Groups: map[string]Group{"sleep": {MaxCPUs: 1}}})
+	start := time.Now()
+	p.Add(Process{Command: "sleep 0.2", Group: "sleep"})
+	p.Add(Process{Command: "sleep 0.2", Group: "sleep"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Error("expected processes in group to run one at a time")
+	}
+}
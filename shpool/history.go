@@ -0,0 +1,233 @@
+package shpool
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Policy determines the order in which waiting processes are started.
+type Policy int
+
+const (
+	// FIFO starts processes in the order they were added. This is the default.
+	FIFO Policy = iota
+	// LongestFirst starts the processes with the longest wall time in the
+	// History first to minimize the total run time. Processes not in the
+	// History are started after those that are, in the order they were added.
+	LongestFirst
+)
+
+// Stats are the observed resource usage for a class of processes.
+type Stats struct {
+	// Runs is the number of successful runs recorded.
+	Runs int
+	// WallTime is the mean wall time.
+	WallTime time.Duration
+	// PeakMemory is the largest maximum resident set size seen in bytes.
+	PeakMemory int64
+}
+
+// History records the wall time and peak memory of processes, keyed by
+// Process.Class or, if that is empty, by Process.Prefix. It is used by the
+// LongestFirst Policy.
+type History struct {
+	mu    sync.Mutex
+	path  string
+	stats map[string]Stats
+	// added holds the runs recorded since the History was last loaded or
+	// saved. These are merged into the file by Save.
+	added map[string]Stats
+}
+
+// NewHistory returns a History that is loaded from and saved to path. If path
+// does not exist, the History is empty. If path is "", the History is only
+// kept in memory.
+func NewHistory(path string) (*History, error) {
+	h := &History{path: path, stats: make(map[string]Stats), added: make(map[string]Stats)}
+	if path == "" {
+		return h, nil
+	}
+	var err error
+	if h.stats, err = readHistory(path); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// readHistory reads the stats saved at path, which may not exist.
+func readHistory(path string) (map[string]Stats, error) {
+	stats := make(map[string]Stats)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "[shpool] error reading history")
+	}
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return nil, errors.Wrap(err, "[shpool] error parsing history")
+	}
+	return stats, nil
+}
+
+// Save merges the runs recorded since the History was loaded into the file
+// at its path. The file is locked (path + ".lock") while it is read and
+// written so that programs sharing the path do not lose each other's runs,
+// and it is replaced atomically so that they do not see a partial History.
+func (h *History) Save() error {
+	if h.path == "" {
+		return nil
+	}
+	lock, err := os.OpenFile(h.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "[shpool] error locking history")
+	}
+	// closing the file releases the lock.
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "[shpool] error locking history")
+	}
+	stats, err := readHistory(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	for class, a := range h.added {
+		stats[class] = merge(stats[class], a)
+	}
+	b, err := json.MarshalIndent(stats, "", " ")
+	if err == nil {
+		h.stats, h.added = stats, make(map[string]Stats)
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeHistory(h.path, b)
+}
+
+// merge returns the stats for the runs in both a and b.
+func merge(a, b Stats) Stats {
+	if a.Runs+b.Runs == 0 {
+		return a
+	}
+	s := Stats{Runs: a.Runs + b.Runs, PeakMemory: a.PeakMemory}
+	s.WallTime = (a.WallTime*time.Duration(a.Runs) + b.WallTime*time.Duration(b.Runs)) / time.Duration(s.Runs)
+	if b.PeakMemory > s.PeakMemory {
+		s.PeakMemory = b.PeakMemory
+	}
+	return s
+}
+
+// writeHistory atomically replaces the file at path with b.
+func writeHistory(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "[shpool] error saving history")
+	}
+	_, err = f.Write(b)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "[shpool] error saving history")
+	}
+	return nil
+}
+
+// Get returns the Stats for a class of processes.
+func (h *History) Get(class string) (Stats, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.stats[class]
+	return s, ok
+}
+
+// Record a successful run of a class of processes.
+func (h *History) Record(class string, wall time.Duration, peakMemory int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	run := Stats{Runs: 1, WallTime: wall, PeakMemory: peakMemory}
+	h.stats[class] = merge(h.stats[class], run)
+	h.added[class] = merge(h.added[class], run)
+}
+
+// class returns the key for p in the History.
+func (p *process) class() string {
+	if p.p.Class != "" {
+		return p.p.Class
+	}
+	return p.p.Prefix
+}
+
+// record adds a finished process to the History.
+func (h *History) record(p *process) {
+	if p.err != nil || p.c == nil || p.c.ProcessState == nil {
+		return
+	}
+	var mem int64
+	if ru, ok := p.c.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		// Maxrss is in bytes on macOS and in kilobytes elsewhere.
+		mem = int64(ru.Maxrss)
+		if runtime.GOOS != "darwin" {
+			mem *= 1024
+		}
+	}
+	h.Record(p.class(), p.duration, mem)
+}
+
+// wall returns the mean wall time of the class of p or -1 if it is unknown.
+func (h *History) wall(p *process) time.Duration {
+	if s, ok := h.Get(p.class()); ok {
+		return s.WallTime
+	}
+	return -1
+}
+
+// order sorts waiting according to the policy.
+func order(waiting []*process, policy Policy, h *History) {
+	if policy != LongestFirst || h == nil {
+		return
+	}
+	for _, w := range waiting {
+		w.wall = h.wall(w)
+	}
+	sort.SliceStable(waiting, func(i, j int) bool { return waiting[i].wall > waiting[j].wall })
+}
+
+// enqueue adds p to the waiting processes in the order of the Policy, after
+// those with the same wall time or, if first is set, before them. Since the
+// waiting processes stay sorted, they are not sorted again for each start.
+// must be called in a lock
+func (pool *Pool) enqueue(p *process, first bool) {
+	w := pool.waitingProcesses
+	i := len(w)
+	if first {
+		i = 0
+	}
+	if pool.options.Policy == LongestFirst && pool.options.History != nil {
+		i = sort.Search(len(w), func(j int) bool {
+			if first {
+				return w[j].wall <= p.wall
+			}
+			return w[j].wall < p.wall
+		})
+	}
+	w = append(w, nil)
+	copy(w[i+1:], w[i:])
+	w[i] = p
+	pool.waitingProcesses = w
+}
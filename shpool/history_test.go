@@ -0,0 +1,107 @@
+package shpool
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+
+	h, err := NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(2, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, History: h})
+	p.Add(Process{Command: "sleep 0.2", Class: "slow"})
+	p.Add(Process{Command: "true", Prefix: "fast"})
+	p.Add(Process{Command: "exit 1", Prefix: "fails"})
+	p.Wait()
+
+	h, err = NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, ok := h.Get("slow")
+	if !ok || slow.Runs != 1 || slow.WallTime < 200*time.Millisecond || slow.PeakMemory <= 0 {
+		t.Fatalf("unexpected stats for slow: %+v", slow)
+	}
+	if _, ok := h.Get("fast"); !ok {
+		t.Fatal("expected stats keyed by prefix")
+	}
+	if _, ok := h.Get("fails"); ok {
+		t.Fatal("expected failed processes not to be recorded")
+	}
+	h.Record("slow", 400*time.Millisecond, 0)
+	if s, _ := h.Get("slow"); s.Runs != 2 || s.WallTime < 300*time.Millisecond || s.PeakMemory != slow.PeakMemory {
+		t.Fatalf("unexpected stats after Record: %+v", s)
+	}
+	// programs that share the file keep each other's runs.
+	h2, err := NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2.Record("other", time.Second, 0)
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = NewHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := h.Get("slow"); s.Runs != 2 {
+		t.Errorf("expected 2 runs of slow, got %+v", s)
+	}
+	if s, _ := h.Get("other"); s.Runs != 1 {
+		t.Errorf("expected 1 run of other, got %+v", s)
+	}
+}
+
+func TestLongestFirst(t *testing.T) {
+	h, _ := NewHistory("")
+	h.Record("short", time.Second, 0)
+	h.Record("long", 10*time.Second, 0)
+	procs := []Process{{Prefix: "new1"}, {Prefix: "short"}, {Prefix: "new2"}, {Prefix: "long"}}
+	est := func(p Process) time.Duration { return time.Second }
+	sim, err := Simulate(1, procs, est, &Options{Policy: LongestFirst, History: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// long, short, then the unknown processes in order.
+	exp := []time.Duration{2 * time.Second, time.Second, 3 * time.Second, 0}
+	for i, e := range exp {
+		if sim.Starts[i] != e {
+			t.Errorf("expected %s to start at %s, got %s", procs[i].Prefix, e, sim.Starts[i])
+		}
+	}
+	// a pool keeps its waiting processes in the same order.
+	p := New(1, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, Policy: LongestFirst, History: h})
+	p.Pause()
+	for _, pr := range procs {
+		pr.Command = "true"
+		p.Add(pr)
+	}
+	p.mu.Lock()
+	var got []string
+	for _, w := range p.waitingProcesses {
+		got = append(got, w.p.Prefix)
+	}
+	p.mu.Unlock()
+	if strings.Join(got, " ") != "long short new1 new2" {
+		t.Errorf("unexpected order: %v", got)
+	}
+	p.Resume()
+	p.Wait()
+}
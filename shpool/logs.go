@@ -0,0 +1,188 @@
+package shpool
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// plogs are the per-process log files used when Options.LogDir is set.
+type plogs struct {
+	out, err *logFile
+	// paths of the logs. these end in .gz once the process is finished.
+	// must be accessed in a lock.
+	outPath, errPath string
+	// base is the path of the logs without .out or .err.
+	base string
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// logName returns a unique base path in the LogDir for a process with the given prefix.
+// must be called in a lock
+func (pool *Pool) logName(prefix string) string {
+	name := unsafeName.ReplaceAllString(prefix, "_")
+	if name == "" || name[0] == '.' {
+		name = "process" + name
+	}
+	base := filepath.Join(pool.options.LogDir, name)
+	for i := 2; ; i++ {
+		if !pool.logNames[base] && !exists(base+".out") && !exists(base+".out.gz") &&
+			!exists(base+".err") && !exists(base+".err.gz") {
+			break
+		}
+		base = filepath.Join(pool.options.LogDir, name+"-"+strconv.Itoa(i))
+	}
+	pool.logNames[base] = true
+	return base
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// openLogs creates the stdout and stderr logs for p.
+// must be called in a lock
+func (pool *Pool) openLogs(p *process) error {
+	if err := os.MkdirAll(pool.options.LogDir, 0755); err != nil {
+		return errors.Wrap(err, "[shpool] error creating log directory")
+	}
+	base := pool.logName(p.p.Prefix)
+	l := &plogs{outPath: base + ".out", errPath: base + ".err", base: base}
+	var err error
+	if l.out, err = pool.createLog(l.outPath); err != nil {
+		return err
+	}
+	if l.err, err = pool.createLog(l.errPath); err != nil {
+		l.out.f.Close()
+		return err
+	}
+	p.logs = l
+	return nil
+}
+
+// logFile is a log that is rotated when it reaches max bytes (if max > 0).
+// It is written by a single goroutine.
+type logFile struct {
+	f         *os.File
+	path      string
+	size, max int64
+	// keep is the number of rotated files to keep, or all if 0.
+	keep int
+	// rotated is the number of times the log has been rotated.
+	rotated int
+}
+
+func (pool *Pool) createLog(path string) (*logFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "[shpool] error creating log file")
+	}
+	return &logFile{f: f, path: path, max: pool.options.LogMaxSize, keep: pool.options.LogMaxFiles}, nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	if l.max > 0 && l.size > 0 && l.size+int64(len(b)) > l.max {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate gzips the log to path.N.gz, removes rotated files beyond keep and
+// starts a new log.
+func (l *logFile) rotate() error {
+	l.rotated++
+	if _, err := gzipTo(l.f, l.path+"."+strconv.Itoa(l.rotated)+".gz"); err != nil {
+		return err
+	}
+	if l.keep > 0 && l.rotated > l.keep {
+		os.Remove(l.path + "." + strconv.Itoa(l.rotated-l.keep) + ".gz")
+	}
+	f, err := os.Create(l.path)
+	if err != nil {
+		return errors.Wrap(err, "[shpool] error creating log file")
+	}
+	l.f, l.size = f, 0
+	return nil
+}
+
+// close the logs for a finished process, returning the last n lines of stderr.
+// The logs are compressed and their new paths are returned.
+func (l *plogs) close(n int) (outPath, errPath string, tail []byte, err error) {
+	if n > 0 {
+		tail = lastLines(l.err.f, n)
+	}
+	outPath, err = gzipFile(l.out.f)
+	errPath, e := gzipFile(l.err.f)
+	if err == nil {
+		err = e
+	}
+	return outPath, errPath, tail, err
+}
+
+// lastLines returns (up to) the last n lines in f, reading at most 64KB.
+func lastLines(f *os.File, n int) []byte {
+	st, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	off := st.Size() - 65536
+	if off < 0 {
+		off = 0
+	}
+	b := make([]byte, st.Size()-off)
+	if _, err := f.ReadAt(b, off); err != nil && err != io.EOF {
+		return nil
+	}
+	b = bytes.TrimRight(b, "\n")
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == '\n' {
+			if n--; n == 0 {
+				return b[i+1:]
+			}
+		}
+	}
+	return b
+}
+
+// gzipFile compresses f to f.Name() + ".gz", closes and removes f and returns
+// the new path.
+func gzipFile(f *os.File) (string, error) {
+	return gzipTo(f, f.Name()+".gz")
+}
+
+// gzipTo compresses f to path, closes and removes f and returns path.
+func gzipTo(f *os.File, path string) (string, error) {
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return f.Name(), err
+	}
+	gzf, err := os.Create(path)
+	if err != nil {
+		return f.Name(), errors.Wrap(err, "[shpool] error creating compressed log")
+	}
+	gz := gzip.NewWriter(gzf)
+	_, err = io.Copy(gz, f)
+	if err == nil {
+		err = gz.Close()
+	}
+	if e := gzf.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path)
+		return f.Name(), errors.Wrap(err, "[shpool] error compressing log")
+	}
+	return path, os.Remove(f.Name())
+}
@@ -0,0 +1,134 @@
+package shpool
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readGz(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a log from an earlier run is not overwritten.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a_b-3.err.gz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf syncBuffer
+	p := New(2, log.New(&buf, "", 0), &Options{Quiet: true, LogDir: dir, LogTail: 2})
+	p.Add(Process{Command: "echo out-a; echo err-a >&2", Prefix: "a/b"})
+	p.Add(Process{Command: "echo out-b; echo 1 >&2; echo 2 >&2; echo 3 >&2; exit 1", Prefix: "a/b"})
+	p.Add(Process{Command: "true", Prefix: "a/b"})
+	if err := p.Wait(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	results := p.Results()
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	if results[0].StdoutLog != filepath.Join(dir, "a_b.out.gz") || results[1].StderrLog != filepath.Join(dir, "a_b-2.err.gz") ||
+		results[2].StderrLog != filepath.Join(dir, "a_b-4.err.gz") {
+		t.Fatalf("unexpected log paths: %+v", results)
+	}
+	if out := readGz(t, results[0].StdoutLog); out != "out-a\n" {
+		t.Errorf("unexpected stdout log: %q", out)
+	}
+	if out := readGz(t, results[1].StderrLog); out != "1\n2\n3\n" {
+		t.Errorf("unexpected stderr log: %q", out)
+	}
+	if results[1].ExitCode != 1 || results[1].Err == nil {
+		t.Errorf("expected failed result, got: %+v", results[1])
+	}
+	if !strings.Contains(buf.String(), "2\n3") || strings.Contains(buf.String(), "1\n2\n3") {
+		t.Errorf("expected last 2 lines of stderr in log, got: %s", buf.String())
+	}
+}
+
+func TestLastLines(t *testing.T) {
+	f, err := ioutil.TempFile("", "shpool-lines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("a\nb\nc\n")
+	if got := string(lastLines(f, 2)); got != "b\nc" {
+		t.Errorf("expected b\\nc, got %q", got)
+	}
+	if got := string(lastLines(f, 10)); got != "a\nb\nc" {
+		t.Errorf("expected all lines, got %q", got)
+	}
+}
+
+func TestLogDirKillAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := New(1, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, LogDir: dir})
+	p.Add(Process{Command: "echo killed; sleep 10", Prefix: "k"})
+	time.Sleep(200 * time.Millisecond)
+	p.KillAll()
+	if err := p.Wait(); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+	r := p.Results()
+	if len(r) != 1 || r[0].StdoutLog != filepath.Join(dir, "k.out.gz") {
+		t.Fatalf("expected the compressed log in the result, got %+v", r)
+	}
+	if out := readGz(t, r[0].StdoutLog); out != "killed\n" {
+		t.Errorf("unexpected stdout log: %q", out)
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := New(1, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, LogDir: dir, LogMaxSize: 10, LogMaxFiles: 2})
+	p.Add(Process{Command: "for i in 1 2 3 4; do echo line-$i; sleep 0.05; done", Prefix: "r"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// each 7 byte line is in its own log; the first rotated log is removed.
+	if exists(filepath.Join(dir, "r.out.1.gz")) {
+		t.Error("expected the oldest rotated log to be removed")
+	}
+	for name, exp := range map[string]string{"r.out.2.gz": "line-2\n", "r.out.3.gz": "line-3\n", "r.out.gz": "line-4\n"} {
+		if got := readGz(t, filepath.Join(dir, name)); got != exp {
+			t.Errorf("expected %q in %s, got %q", exp, name, got)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package shpool
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultGroupMemory is the number of bytes of output from each process that
+// are held in memory when grouping output before spilling to a temp file.
+var DefaultGroupMemory = 1 << 20
+
+// DefaultMaxPending is the default for Options.MaxPending.
+var DefaultMaxPending = 256
+
+// group buffers the output of a single process so that it can be written as a
+// single block when the process finishes.
+type group struct {
+	buf   bytes.Buffer
+	f     *os.File
+	limit int
+}
+
+func (g *group) Write(b []byte) (int, error) {
+	if g.f == nil && g.buf.Len()+len(b) > g.limit {
+		// not tempclean.TempFile which is not safe for concurrent use. WriteTo
+		// removes the file.
+		f, err := ioutil.TempFile("", "shpool-*.out")
+		if err != nil {
+			return 0, errors.Wrap(err, "[shpool] error creating temp file for output")
+		}
+		g.f = f
+		if _, err := g.buf.WriteTo(g.f); err != nil {
+			return 0, errors.Wrap(err, "[shpool] error writing output to temp file")
+		}
+	}
+	if g.f != nil {
+		return g.f.Write(b)
+	}
+	return g.buf.Write(b)
+}
+
+// WriteTo writes the buffered output to w and releases any resources.
+func (g *group) WriteTo(w io.Writer) (int64, error) {
+	if g.f == nil {
+		return g.buf.WriteTo(w)
+	}
+	defer os.Remove(g.f.Name())
+	defer g.f.Close()
+	if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, g.f)
+}
+
+// outputs tracks the grouped output of finished processes. It is written
+// by a single goroutine so that large blocks don't hold up the pool.
+type outputs struct {
+	mu sync.Mutex
+	// next is the index of the next process to write with KeepOrder.
+	next int
+	// pending holds processes that finished before the process at next.
+	pending map[int]*process
+	// ready holds processes to write in order.
+	ready   []*process
+	writing bool
+	wg      sync.WaitGroup
+}
+
+// groupLoggers returns a logger like pool.logger that writes to the (new)
+// stderr group of p and the stdout group of p.
+func (pool *Pool) groupLoggers(p *process) (wlogger, *group) {
+	limit := pool.options.GroupMemory
+	if limit <= 0 {
+		limit = DefaultGroupMemory
+	}
+	// a retried process adds to the output of the earlier attempts.
+	if p.out == nil {
+		p.out, p.errOut = &group{limit: limit}, &group{limit: limit}
+	}
+	pool.logger.mu.Lock()
+	l := log.New(p.errOut, pool.logger.Prefix(), pool.logger.Flags())
+	pool.logger.mu.Unlock()
+	return wlogger{&sync.Mutex{}, l}, p.out
+}
+
+// maxPending returns the number of processes after the next one to write
+// with KeepOrder that may start.
+func (pool *Pool) maxPending() int {
+	n := pool.options.MaxPending
+	if n <= 0 {
+		n = DefaultMaxPending
+	}
+	if n < pool.totalCpus {
+		n = pool.totalCpus
+	}
+	return n
+}
+
+// emit queues the grouped output of p to be written. With KeepOrder, this
+// holds the output until the output of all processes added before p is
+// queued. p.out is nil for a process that never started.
+func (pool *Pool) emit(p *process) {
+	if !pool.options.Group && !pool.options.KeepOrder {
+		return
+	}
+	o := &pool.outputs
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !pool.options.KeepOrder {
+		if p.out != nil {
+			o.ready = append(o.ready, p)
+		}
+	} else {
+		o.pending[p.idx] = p
+		for {
+			q, ok := o.pending[o.next]
+			if !ok {
+				break
+			}
+			o.ready = append(o.ready, q)
+			delete(o.pending, o.next)
+			o.next++
+		}
+	}
+	pool.startWriting()
+}
+
+// flushOutputs queues any output that is still held (in order) because an
+// earlier process never finished and waits for all output to be written.
+func (pool *Pool) flushOutputs() {
+	o := &pool.outputs
+	o.mu.Lock()
+	for len(o.pending) != 0 {
+		if q, ok := o.pending[o.next]; ok {
+			o.ready = append(o.ready, q)
+			delete(o.pending, o.next)
+		}
+		o.next++
+	}
+	pool.startWriting()
+	o.mu.Unlock()
+	o.wg.Wait()
+}
+
+// startWriting starts the goroutine that writes the ready output.
+// must be called with outputs.mu held.
+func (pool *Pool) startWriting() {
+	o := &pool.outputs
+	if o.writing || len(o.ready) == 0 {
+		return
+	}
+	o.writing = true
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		for {
+			o.mu.Lock()
+			if len(o.ready) == 0 {
+				o.writing = false
+				o.mu.Unlock()
+				return
+			}
+			p := o.ready[0]
+			o.ready[0] = nil
+			o.ready = o.ready[1:]
+			o.mu.Unlock()
+			pool.writeGroups(p)
+		}
+	}()
+}
+
+// writeGroups writes the stdout of p to the Output and its stderr, which
+// has the prefixes and decoration of the logger, to the logger.
+func (pool *Pool) writeGroups(p *process) {
+	if p.out == nil {
+		return
+	}
+	w := pool.options.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	// the Output may be the writer of the logger.
+	pool.logger.mu.Lock()
+	_, err := p.out.WriteTo(w)
+	if _, eerr := p.errOut.WriteTo(pool.logger.Writer()); err == nil {
+		err = eerr
+	}
+	pool.logger.mu.Unlock()
+	if err != nil {
+		pool.logger.Printf("error writing output: %s", err)
+	}
+}
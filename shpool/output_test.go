@@ -0,0 +1,92 @@
+package shpool
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func TestKeepOrder(t *testing.T) {
+	var buf syncBuffer
+	p := New(2, log.New(&buf, "", 0), &Options{Quiet: true, KeepOrder: true, GroupMemory: 4, Output: &buf})
+	p.Add(Process{Command: "sleep 0.3; echo a1; sleep 0.1; echo a2", Prefix: "a"})
+	p.Add(Process{Command: "echo b1; echo b2", Prefix: "b"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines of output, got: %q", lines)
+	}
+	for i, exp := range []string{"a1", "a2", "b1", "b2"} {
+		if !strings.HasSuffix(lines[i], exp) {
+			t.Errorf("expected line %d to be %s, got %s", i, exp, lines[i])
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var buf, logs syncBuffer
+	p := New(2, log.New(&logs, "", 0), &Options{Quiet: true, Group: true, Output: &buf})
+	p.Add(Process{Command: "echo a1; sleep 0.2; echo a2; echo a3 >&2", Prefix: "a"})
+	p.Add(Process{Command: "sleep 0.1; echo b1; sleep 0.3; echo b2", Prefix: "b"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the stdout is written as is and the stderr goes to the logger.
+	if out := buf.String(); out != "a1\na2\nb1\nb2\n" {
+		t.Errorf("unexpected grouped output: %q", out)
+	}
+	if l := logs.String(); !strings.Contains(l, "a3") || strings.Contains(l, "a1") {
+		t.Errorf("expected only the stderr in the log, got %q", l)
+	}
+}
+
+func TestKeepOrderMaxPending(t *testing.T) {
+	var buf syncBuffer
+	p := New(2, log.New(&buf, "", 0), &Options{Quiet: true, KeepOrder: true, MaxPending: 2, Output: &buf})
+	p.Add(Process{Command: "sleep 0.4", Prefix: "a"})
+	for _, prefix := range []string{"b", "c", "d"} {
+		p.Add(Process{Command: "true", Prefix: prefix})
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	starts := map[string]time.Time{}
+	for _, r := range p.Results() {
+		starts[r.Prefix] = r.Start
+	}
+	// c can't start until the output of a is written.
+	if d := starts["c"].Sub(starts["a"]); d < 300*time.Millisecond {
+		t.Errorf("expected c to wait for a, started after %s", d)
+	}
+}
+
+func TestKeepOrderKillAll(t *testing.T) {
+	var buf syncBuffer
+	p := New(2, log.New(&buf, "", 0), &Options{Quiet: true, KeepOrder: true, Output: &buf})
+	p.Add(Process{Command: "echo a1; sleep 10", Prefix: "a"})
+	p.Add(Process{Command: "echo b1; sleep 10", Prefix: "b"})
+	time.Sleep(300 * time.Millisecond)
+	p.KillAll()
+	p.Wait()
+	out := buf.String()
+	if !strings.Contains(out, "a1") || !strings.Contains(out, "b1") || strings.Index(out, "a1") > strings.Index(out, "b1") {
+		t.Errorf("expected the output of the killed processes in order, got %q", out)
+	}
+}
@@ -0,0 +1,54 @@
+package shpool
+
+import "fmt"
+
+// IOClass is the I/O scheduling class of a process (see ionice(1)).
+type IOClass int
+
+const (
+	// IONone leaves the I/O class unchanged. This is the default.
+	IONone IOClass = iota
+	// IORealtime gets first access to the disk. It usually requires root.
+	IORealtime
+	// IOBestEffort is the normal class. IOPriority orders processes within it.
+	IOBestEffort
+	// IOIdle only gets disk time when no other process needs it.
+	IOIdle
+)
+
+// Validate returns an error if the Process has invalid settings.
+func (p Process) Validate() error {
+	if p.Script != "" && p.Command != "" {
+		return fmt.Errorf("shpool: only one of Command and Script may be set")
+	}
+	if p.Nice < -20 || p.Nice > 19 {
+		return fmt.Errorf("shpool: Nice must be between -20 and 19. got %d", p.Nice)
+	}
+	if p.IOClass < IONone || p.IOClass > IOIdle {
+		return fmt.Errorf("shpool: unknown IOClass: %d", p.IOClass)
+	}
+	if p.IOPriority < 0 || p.IOPriority > 7 {
+		return fmt.Errorf("shpool: IOPriority must be between 0 and 7. got %d", p.IOPriority)
+	}
+	if p.IOPriority != 0 && p.IOClass != IORealtime && p.IOClass != IOBestEffort {
+		return fmt.Errorf("shpool: IOPriority requires IOClass of IORealtime or IOBestEffort")
+	}
+	return nil
+}
+
+// setPriorities applies the Nice and IOClass of p to its process group.
+// These are inherited by any children started after this.
+func (p *process) setPriorities() error {
+	pgid := p.c.Process.Pid
+	if p.p.Nice != 0 {
+		if err := setNice(pgid, p.p.Nice); err != nil {
+			return fmt.Errorf("shpool: error setting nice to %d: %s", p.p.Nice, err)
+		}
+	}
+	if p.p.IOClass != IONone {
+		if err := setIOPriority(pgid, p.p.IOClass, p.p.IOPriority); err != nil {
+			return fmt.Errorf("shpool: error setting io priority: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package shpool
+
+import "syscall"
+
+// from linux/ioprio.h
+const (
+	ioprioWhoPgrp    = 2
+	ioprioClassShift = 13
+)
+
+func setNice(pgid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PGRP, pgid, nice)
+}
+
+func setIOPriority(pgid int, class IOClass, priority int) error {
+	prio := int(class)<<ioprioClassShift | priority
+	if _, _, e := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoPgrp, uintptr(pgid), uintptr(prio)); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package shpool
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setNice(pgid, nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PGRP, pgid, nice)
+}
+
+func setIOPriority(pgid int, class IOClass, priority int) error {
+	return errors.New("io priority is only supported on linux")
+}
@@ -0,0 +1,50 @@
+package shpool
+
+import (
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	bad := []Process{
+		{Command: "true", Nice: 20},
+		{Command: "true", Nice: -21},
+		{Command: "true", IOClass: 4},
+		{Command: "true", IOClass: IOBestEffort, IOPriority: 8},
+		{Command: "true", IOClass: IOIdle, IOPriority: 1},
+		{Command: "true", Script: "true"},
+	}
+	for _, p := range bad {
+		if err := p.Validate(); err == nil {
+			t.Errorf("expected error for %+v", p)
+		}
+	}
+	if err := (Process{Command: "true", Nice: 10, IOClass: IOBestEffort, IOPriority: 7}).Validate(); err != nil {
+		t.Error(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected Add to panic for invalid process")
+		}
+	}()
+	quietPool(1).Add(Process{Command: "true", Nice: 100})
+}
+
+func TestNice(t *testing.T) {
+	var buf syncBuffer
+	p := New(1, log.New(&buf, "", 0), &Options{Quiet: true})
+	// the sleep gives time for the priority to be set before ps is run.
+	p.Add(Process{Command: "sleep 0.2; ps -o ni= -p $$", Nice: 7, IOClass: IOIdle})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "error setting io priority") {
+		t.Skip("io priority not supported: " + out)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(out), " 7") {
+		t.Errorf("expected nice of 7, got: %s", out)
+	}
+}
@@ -0,0 +1,193 @@
+package shpool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxProgressLines is the maximum number of running processes shown.
+var maxProgressLines = 10
+
+// progress is an io.Writer that keeps a status area at the bottom of a
+// terminal. Anything written to it scrolls above the status area.
+type progress struct {
+	mu sync.Mutex
+	w  io.Writer
+	// width, if set, returns the width of the terminal. Longer status lines
+	// are truncated since wrapped lines would not all be cleared.
+	width func() int
+	// status is the currently displayed status and lines is the number of
+	// lines that it takes.
+	status string
+	lines  int
+}
+
+// clear removes the status area.
+// must be called in a lock
+func (p *progress) clear() {
+	if p.lines > 0 {
+		p.w.Write(bytes.Repeat([]byte("\x1b[1A\x1b[2K"), p.lines))
+	}
+	p.lines = 0
+}
+
+// draw writes the status area.
+// must be called in a lock
+func (p *progress) draw() {
+	if p.status == "" {
+		return
+	}
+	status := p.status
+	if p.width != nil {
+		status = truncateLines(status, p.width())
+	}
+	io.WriteString(p.w, status)
+	p.lines = strings.Count(status, "\n")
+}
+
+// truncateLines truncates each line in s to fewer than width characters so
+// that the terminal does not wrap it.
+func truncateLines(s string, width int) string {
+	if width <= 1 {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		nl := strings.HasSuffix(l, "\n")
+		if r := []rune(strings.TrimSuffix(l, "\n")); len(r) >= width {
+			lines[i] = string(r[:width-1])
+			if nl {
+				lines[i] += "\n"
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// termWidth returns the number of columns of the terminal fd or 0 if unknown.
+func termWidth(fd uintptr) int {
+	ws, err := unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0
+	}
+	return int(ws.Col)
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
+}
+
+// update replaces the status area with status.
+func (p *progress) update(status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	p.status = status
+	p.draw()
+}
+
+// showProgress updates the status area until stop is closed or the pool is
+// killed. It closes done when it returns.
+func (pool *Pool) showProgress(stop, done chan struct{}) {
+	defer close(done)
+	t := time.NewTicker(250 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			pool.progress.update(pool.status(time.Now()))
+		case <-stop:
+			return
+		case <-pool.ctx.Done():
+			pool.progress.update("")
+			return
+		}
+	}
+}
+
+// stopProgress stops showProgress, if it is running, and waits for it to
+// return. It is started again by Add.
+func (pool *Pool) stopProgress() {
+	pool.mu.Lock()
+	stop, done := pool.progressStop, pool.progressDone
+	pool.progressStop, pool.progressDone = nil, nil
+	pool.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// status returns a description of the running processes, the counts of
+// queued, done and failed processes, and an estimate of the time remaining.
+// It returns "" if there are no running or queued processes.
+func (pool *Pool) status(now time.Time) string {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if len(pool.running) == 0 && len(pool.waitingProcesses) == 0 {
+		return ""
+	}
+	running := make([]*process, 0, len(pool.running))
+	for _, p := range pool.running {
+		running = append(running, p)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].idx < running[j].idx })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "running: %d queued: %d done: %d failed: %d cpus: %d/%d eta: %s\n",
+		len(pool.running), len(pool.waitingProcesses), len(pool.results)-len(pool.errs), len(pool.errs),
+		pool.runningCpus, pool.totalCpus, pool.eta(now))
+	for i, p := range running {
+		if i == maxProgressLines {
+			fmt.Fprintf(&b, "  ... and %d more\n", len(running)-i)
+			break
+		}
+		prefix := p.p.Prefix
+		if len(prefix) > 60 {
+			prefix = prefix[:60]
+		}
+		fmt.Fprintf(&b, "  %s [%d cpus] %s\n", prefix, p.p.CPUs, now.Sub(p.started).Truncate(time.Second))
+	}
+	return b.String()
+}
+
+// eta estimates the time remaining from the mean duration of the finished
+// processes. It assumes that the remaining processes keep all cpus busy.
+// must be called in a lock
+func (pool *Pool) eta(now time.Time) string {
+	var total time.Duration
+	var n int
+	for _, r := range pool.results {
+		if r.Duration > 0 {
+			total += r.Duration
+			n++
+		}
+	}
+	if n == 0 {
+		return "?"
+	}
+	mean := float64(total) / float64(n)
+	// cpu-weighted work remaining.
+	var work float64
+	for _, p := range pool.waitingProcesses {
+		work += float64(p.p.CPUs) * mean
+	}
+	for _, p := range pool.running {
+		if left := mean - float64(now.Sub(p.started)); left > 0 {
+			work += float64(p.p.CPUs) * left
+		}
+	}
+	return time.Duration(work / float64(pool.totalCpus)).Truncate(time.Second).String()
+}
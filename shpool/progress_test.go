@@ -0,0 +1,74 @@
+package shpool
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var buf bytes.Buffer
+	p := &progress{w: &buf}
+	p.update("a\nb\n")
+	p.Write([]byte("log line\n"))
+	// the status is cleared (2 lines), then the log line is written and the status redrawn.
+	exp := "a\nb\n" + strings.Repeat("\x1b[1A\x1b[2K", 2) + "log line\na\nb\n"
+	if buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+	buf.Reset()
+	p.update("")
+	if buf.String() != strings.Repeat("\x1b[1A\x1b[2K", 2) {
+		t.Fatalf("expected status to be cleared, got %q", buf.String())
+	}
+}
+
+func TestProgressTruncate(t *testing.T) {
+	var buf bytes.Buffer
+	p := &progress{w: &buf, width: func() int { return 5 }}
+	p.update("abcdefg\nab\nxyzxyz")
+	if exp := "abcd\nab\nxyzx"; buf.String() != exp {
+		t.Fatalf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+func TestProgressStop(t *testing.T) {
+	var buf bytes.Buffer
+	p := quietPool(1)
+	p.progress = &progress{w: &buf}
+	p.Add(Process{Command: "sleep 0.6"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the status was drawn and then cleared by Wait.
+	s := buf.String()
+	if !strings.Contains(s, "running: 1") || !strings.HasSuffix(s, "\x1b[1A\x1b[2K") {
+		t.Fatalf("unexpected output: %q", s)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if buf.String() != s {
+		t.Fatal("expected no redraws after Wait")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	p := quietPool(1)
+	if s := p.status(time.Now()); s != "" {
+		t.Fatalf("expected empty status for idle pool, got %q", s)
+	}
+	p.Add(Process{Command: "true", Prefix: "first"})
+	p.Wait()
+	p.Add(Process{Command: "sleep 1", Prefix: "slow"})
+	p.Add(Process{Command: "true", Prefix: "queued"})
+	s := p.status(time.Now())
+	for _, exp := range []string{"running: 1", "queued: 1", "done: 1", "failed: 0", "cpus: 1/1", "slow [1 cpus]"} {
+		if !strings.Contains(s, exp) {
+			t.Errorf("expected %q in status: %s", exp, s)
+		}
+	}
+	if strings.Contains(s, "eta: ?") {
+		t.Errorf("expected an eta from the finished process: %s", s)
+	}
+	p.KillAll()
+}
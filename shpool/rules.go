@@ -0,0 +1,125 @@
+package shpool
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+// PatternError is the error for a process that wrote a line matching its
+// FailOnStdout or FailOnStderr pattern.
+type PatternError struct {
+	// Stream is "stdout" or "stderr".
+	Stream string
+	// Line is the first line that matched.
+	Line string
+	// Err is the error from the command, if any.
+	Err error
+}
+
+func (e *PatternError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s matched failure pattern: %q", e.Stream, e.Line)
+	}
+	return fmt.Sprintf("%s matched failure pattern: %q (%s)", e.Stream, e.Line, e.Err)
+}
+
+// Unwrap returns the error from the command, if any.
+func (e *PatternError) Unwrap() error {
+	return e.Err
+}
+
+// maxLine is the number of bytes of a line that are matched. Only the end of
+// a longer line is kept.
+var maxLine = 64 * 1024
+
+// matcher is an io.Writer that checks each line written to it against the
+// fail and success patterns and records the first line that matches each.
+type matcher struct {
+	fail, success *regexp.Regexp
+	// partial line from the last Write.
+	buf                   []byte
+	failLine, successLine []byte
+}
+
+func (m *matcher) Write(b []byte) (int, error) {
+	n := len(b)
+	if len(m.buf) != 0 {
+		b = append(m.buf, b...)
+		m.buf = m.buf[:0]
+	}
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			m.buf = append(m.buf, b...)
+			if len(m.buf) > maxLine {
+				m.buf = m.buf[:copy(m.buf, m.buf[len(m.buf)-maxLine:])]
+			}
+			return n, nil
+		}
+		m.check(b[:i])
+		b = b[i+1:]
+	}
+}
+
+func (m *matcher) check(line []byte) {
+	if m.fail != nil && m.failLine == nil && m.fail.Match(line) {
+		m.failLine = append([]byte{}, line...)
+	}
+	if m.success != nil && m.successLine == nil && m.success.Match(line) {
+		m.successLine = append([]byte{}, line...)
+	}
+}
+
+// flush checks the last line if it did not end with a newline.
+func (m *matcher) flush() {
+	if len(m.buf) != 0 {
+		m.check(m.buf)
+		m.buf = m.buf[:0]
+	}
+}
+
+// matchers returns the stdout and stderr matchers for p or nil if p has no
+// patterns for that stream.
+func (p *process) matchers() (stdout, stderr *matcher) {
+	if p.p.FailOnStdout != nil || p.p.SuccessOnStdout != nil {
+		stdout = &matcher{fail: p.p.FailOnStdout, success: p.p.SuccessOnStdout}
+	}
+	if p.p.FailOnStderr != nil || p.p.SuccessOnStderr != nil {
+		stderr = &matcher{fail: p.p.FailOnStderr, success: p.p.SuccessOnStderr}
+	}
+	return stdout, stderr
+}
+
+// applyRules returns the error for p after applying the SuccessExitCodes and
+// the output patterns to err, the error from the command.
+func (p *process) applyRules(err error) error {
+	for _, m := range []*matcher{p.stdoutMatch, p.stderrMatch} {
+		if m != nil {
+			m.flush()
+		}
+	}
+	// a failure pattern takes precedence.
+	if m := p.stdoutMatch; m != nil && m.failLine != nil {
+		return &PatternError{Stream: "stdout", Line: string(m.failLine), Err: err}
+	}
+	if m := p.stderrMatch; m != nil && m.failLine != nil {
+		return &PatternError{Stream: "stderr", Line: string(m.failLine), Err: err}
+	}
+	if err == nil {
+		return nil
+	}
+	if (p.stdoutMatch != nil && p.stdoutMatch.successLine != nil) || (p.stderrMatch != nil && p.stderrMatch.successLine != nil) {
+		return nil
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		code := ee.ExitCode()
+		for _, c := range p.p.SuccessExitCodes {
+			if c == code && code != -1 {
+				return nil
+			}
+		}
+	}
+	return err
+}
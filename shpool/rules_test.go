@@ -0,0 +1,76 @@
+package shpool
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestSuccessExitCodes(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Command: "exit 1", SuccessExitCodes: []int{1}})
+	if err := p.Wait(); err != nil {
+		t.Fatalf("expected exit 1 to be success, got: %v", err)
+	}
+	p.Add(Process{Command: "exit 2", SuccessExitCodes: []int{1}})
+	if err := p.Wait(); err == nil {
+		t.Fatal("expected exit 2 to be an error")
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Command: "echo ok; echo 'ERROR: bad thing' >&2; echo more >&2", Prefix: "fail",
+		FailOnStderr: regexp.MustCompile(`^ERROR:`)})
+	p.Add(Process{Command: "echo 'no variants found'; exit 1", Prefix: "succeed",
+		SuccessOnStdout: regexp.MustCompile(`no variants`)})
+	// no trailing newline.
+	p.Add(Process{Command: "printf 'x\\nFATAL'", Prefix: "partial",
+		FailOnStdout: regexp.MustCompile(`FATAL`)})
+	err := p.Wait()
+	var es Errors
+	if !errors.As(err, &es) || len(es) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for _, e := range es {
+		var pe *PatternError
+		if !errors.As(e, &pe) {
+			t.Fatalf("expected a *PatternError, got: %v", e)
+		}
+		switch e.Prefix {
+		case "fail":
+			if pe.Stream != "stderr" || pe.Line != "ERROR: bad thing" || pe.Err != nil {
+				t.Errorf("unexpected error: %+v", pe)
+			}
+		case "partial":
+			if pe.Stream != "stdout" || pe.Line != "FATAL" {
+				t.Errorf("unexpected error: %+v", pe)
+			}
+		default:
+			t.Errorf("unexpected failure: %v", e)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m := &matcher{fail: regexp.MustCompile(`^bad$`)}
+	m.Write([]byte("good\nb"))
+	m.Write([]byte("ad\nbad"))
+	if string(m.failLine) != "bad" {
+		t.Fatalf("expected line split across writes to match, got %q", m.failLine)
+	}
+
+	// only the end of a long line is kept.
+	m = &matcher{fail: regexp.MustCompile(`xbad$`)}
+	for i := 0; i < 4; i++ {
+		m.Write(bytes.Repeat([]byte("x"), maxLine))
+		if len(m.buf) > maxLine {
+			t.Fatalf("expected at most %d bytes buffered, got %d", maxLine, len(m.buf))
+		}
+	}
+	m.Write([]byte("bad\n"))
+	if len(m.failLine) > maxLine+len("bad") || !bytes.HasSuffix(m.failLine, []byte("xbad")) {
+		t.Fatalf("expected the end of the long line to match, got %d bytes", len(m.failLine))
+	}
+}
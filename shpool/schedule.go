@@ -0,0 +1,142 @@
+package shpool
+
+import (
+	"fmt"
+	"time"
+)
+
+// pick returns the indexes (in increasing order) of the waiting processes
+// to start given the available cpus and the state of the groups (nil if there
+// are no groups). If ok is not nil, it is called for each process that fits
+// and may reject it.
+// This is the scheduling policy used by both the Pool and Simulate.
+func pick(waiting []*process, available int, gs *groupState, ok func(*process) bool) []int {
+	var used []int
+	for i, w := range waiting {
+		if w.p.CPUs > available {
+			continue
+		}
+		if gs != nil && !gs.fits(w, available) {
+			continue
+		}
+		if ok != nil && !ok(w) {
+			continue
+		}
+		available -= w.p.CPUs
+		if gs != nil {
+			gs.start(w)
+		}
+		used = append(used, i)
+	}
+	return used
+}
+
+// Simulation reports the schedule of a set of processes from Simulate.
+type Simulation struct {
+	// Makespan is the time from the start of the first process to the end of the last.
+	Makespan time.Duration
+	// Starts holds the start time of each process relative to the start of
+	// the simulation in the order the processes were given.
+	Starts []time.Duration
+	// Utilization is the fraction of the available CPU-time (cpus * Makespan)
+	// used by the processes.
+	Utilization float64
+}
+
+// DefaultEstimate is the duration of each process in Simulate when no
+// estimate is given.
+const DefaultEstimate = time.Minute
+
+// Simulate replays the scheduling policy of a Pool with the given number of
+// cpus and options (which may be nil) on procs, using estimate to get the
+// duration of each process. If estimate is nil, each process is estimated
+// to take DefaultEstimate. Nothing is run. This is useful for deciding how
+// many cpus to use for a large run.
+func Simulate(cpus int, procs []Process, estimate func(Process) time.Duration, opts *Options) (*Simulation, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if estimate == nil {
+		estimate = func(Process) time.Duration { return DefaultEstimate }
+	}
+	if err := validateGroups(cpus, opts.Groups); err != nil {
+		return nil, err
+	}
+	waiting := make([]*process, len(procs))
+	for i, p := range procs {
+		if p.CPUs == 0 {
+			p.CPUs = 1
+		}
+		if p.CPUs > cpus {
+			return nil, fmt.Errorf("shpool: cant handle a process with more cpus than the pool")
+		}
+		if max := groupMax(p, opts.Groups); max > 0 && p.CPUs > max {
+			return nil, fmt.Errorf("shpool: cant handle a process with more cpus than its group")
+		}
+		waiting[i] = &process{p: p, idx: i}
+	}
+	sim := &Simulation{Starts: make([]time.Duration, len(procs))}
+	// end time of each running process.
+	running := make(map[*process]time.Duration)
+	var now time.Duration
+	var used int
+	var cpuTime float64
+
+	order(waiting, opts.Policy, opts.History)
+	for len(waiting) != 0 || len(running) != 0 {
+		runs := make([]*process, 0, len(running))
+		for p := range running {
+			runs = append(runs, p)
+		}
+		started := pick(waiting, cpus-used, newGroupState(opts.Groups, runs, waiting), nil)
+		for _, i := range started {
+			p := waiting[i]
+			d := estimate(p.p)
+			sim.Starts[p.idx] = now
+			running[p] = now + d
+			used += p.p.CPUs
+			cpuTime += float64(p.p.CPUs) * float64(d)
+		}
+		waiting = remove(waiting, started)
+		if len(started) == 0 && len(running) == 0 {
+			return nil, fmt.Errorf("shpool: %d waiting processes can never start", len(waiting))
+		}
+
+		// advance to the next time a process finishes.
+		next := time.Duration(-1)
+		for _, end := range running {
+			if next == -1 || end < next {
+				next = end
+			}
+		}
+		now = next
+		for p, end := range running {
+			if end == now {
+				used -= p.p.CPUs
+				delete(running, p)
+			}
+		}
+	}
+	sim.Makespan = now
+	if now > 0 {
+		sim.Utilization = cpuTime / (float64(cpus) * float64(now))
+	}
+	return sim, nil
+}
+
+// remove returns waiting without the processes at the (increasing) indexes.
+func remove(waiting []*process, idxs []int) []*process {
+	if len(idxs) == 0 {
+		return waiting
+	}
+	kept := waiting[:0]
+	j := 0
+	for i, w := range waiting {
+		if j < len(idxs) && idxs[j] == i {
+			j++
+			continue
+		}
+		kept = append(kept, w)
+	}
+	return kept
+}
@@ -0,0 +1,75 @@
+package shpool
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	procs := []Process{
+		{Command: "a", CPUs: 2},
+		{Command: "b", CPUs: 2},
+		{Command: "c", CPUs: 4},
+		{Command: "d"},
+	}
+	est := func(p Process) time.Duration {
+		return map[string]time.Duration{"a": 10 * time.Second, "b": 20 * time.Second, "c": 5 * time.Second, "d": 1 * time.Second}[p.Command]
+	}
+	sim, err := Simulate(4, procs, est, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a and b start at 0; c waits for both; d can't fit until a finishes.
+	exp := []time.Duration{0, 0, 20 * time.Second, 10 * time.Second}
+	for i, e := range exp {
+		if sim.Starts[i] != e {
+			t.Errorf("expected process %d to start at %s, got %s", i, e, sim.Starts[i])
+		}
+	}
+	if sim.Makespan != 25*time.Second {
+		t.Errorf("expected makespan of 25s, got %s", sim.Makespan)
+	}
+	// (2*10 + 2*20 + 4*5 + 1) / (4 * 25)
+	if sim.Utilization < 0.80 || sim.Utilization > 0.82 {
+		t.Errorf("unexpected utilization: %f", sim.Utilization)
+	}
+
+	// without an estimate, each process takes DefaultEstimate.
+	sim, err = Simulate(4, procs, nil, nil)
+	if err != nil || sim.Makespan != 3*DefaultEstimate {
+		t.Errorf("expected a makespan of 3 estimates, got %v %v", sim, err)
+	}
+
+	sim, err = Simulate(8, procs, est, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.Makespan != 20*time.Second {
+		t.Errorf("expected makespan of 20s with 8 cpus, got %s", sim.Makespan)
+	}
+
+	if _, err := Simulate(2, procs, est, nil); err == nil {
+		t.Error("expected error for process with too many cpus")
+	}
+
+	// the minimums of the nested groups leave no cpus for x/a.
+	groups := map[string]Group{"x/b": {MinCPUs: 3}, "x/c": {MinCPUs: 3}}
+	procs = []Process{{Group: "x/a", CPUs: 1}, {Group: "x/b", CPUs: 3}, {Group: "x/c", CPUs: 3}}
+	if _, err := Simulate(4, procs, est, &Options{Groups: groups}); err == nil {
+		t.Error("expected error for processes that can never start")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var buf syncBuffer
+	p := New(2, log.New(&buf, "", 0), &Options{DryRun: true})
+	p.Add(Process{Command: "exit 1", Prefix: "fail"})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "dry-run: fail: exit 1") {
+		t.Errorf("expected command in log, got: %s", buf.String())
+	}
+}
@@ -0,0 +1,130 @@
+package shpool
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// scriptSuffixes are used for the temp files of scripts so that error
+// messages from the interpreter are easier to read.
+var scriptSuffixes = map[string]string{
+	"python":  ".py",
+	"python2": ".py",
+	"python3": ".py",
+	"Rscript": ".R",
+	"perl":    ".pl",
+	"bash":    ".sh",
+	"sh":      ".sh",
+}
+
+// interpreter returns the command used to run a script. If interp is empty,
+// the shebang line of the script is used if present, otherwise the Shell.
+func interpreter(script, interp string) []string {
+	if interp != "" {
+		return strings.Fields(interp)
+	}
+	if strings.HasPrefix(script, "#!") {
+		line, _ := bufio.NewReader(strings.NewReader(script[2:])).ReadString('\n')
+		// like the kernel, everything after the interpreter is a single argument.
+		args := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if args[0] != "" {
+			if len(args) == 2 {
+				args[1] = strings.TrimSpace(args[1])
+			}
+			return args
+		}
+	}
+	return []string{Shell}
+}
+
+// writeScript writes script to a temp file and returns the command to run it.
+// This is not tempclean.TempFile which is not safe for concurrent use.
+// The interpreter is called explicitly, even for scripts with a shebang line,
+// to avoid "text file busy" errors from exec'ing a file that was just written.
+func (p *process) writeScript(script, interp string) ([]string, error) {
+	args := interpreter(script, interp)
+	prefix := unsafeName.ReplaceAllString(p.p.Prefix, "_") + "-"
+	t, err := ioutil.TempFile("", "shpool-"+prefix+"*"+scriptSuffix(args))
+	if err != nil {
+		return nil, errors.Wrap(err, "[shpool] error creating temp file")
+	}
+	if _, err := t.Write([]byte(script)); err != nil {
+		t.Close()
+		return nil, errors.Wrap(err, "[shpool] error writing to temp file")
+	}
+	if err := t.Close(); err != nil {
+		return nil, errors.Wrap(err, "[shpool] error closing to temp file")
+	}
+	p.script = t.Name()
+	return append(args, t.Name()), nil
+}
+
+// scriptSuffix returns the suffix for a script run with args.
+func scriptSuffix(args []string) string {
+	// check all args so that, e.g. `/usr/bin/env python3` gives .py
+	for _, a := range args {
+		if s, ok := scriptSuffixes[filepath.Base(a)]; ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// command returns the command for display in logs and errors.
+func (p *process) command() string {
+	if p.p.Script == "" {
+		return p.p.Command
+	}
+	if p.script == "" {
+		return p.p.Script
+	}
+	return strings.Join(append(interpreter(p.p.Script, p.p.Interpreter), p.script), " ")
+}
+
+// removeScript removes the temp file of a process. The Script of a failed
+// process is kept for debugging.
+func (pool *Pool) removeScript(p *process, err error) {
+	if p.script == "" {
+		return
+	}
+	if err == nil || p.p.Script == "" {
+		os.Remove(p.script)
+		return
+	}
+	path, kerr := pool.keepScript(p)
+	if kerr != nil {
+		pool.logger.Printf("error keeping script for failed process: %s -> %s", p.p.Prefix, kerr)
+		return
+	}
+	pool.mu.Lock()
+	p.script = path
+	pool.mu.Unlock()
+	pool.logger.Printf("keeping script for failed process: %s at %s", p.p.Prefix, path)
+}
+
+// keepScript moves the script of p to the LogDir next to the logs of p or,
+// without a LogDir, leaves it in os.TempDir(). It returns the new path.
+func (pool *Pool) keepScript(p *process) (string, error) {
+	if p.logs == nil {
+		return p.script, nil
+	}
+	path := p.logs.base + ".script" + scriptSuffix(interpreter(p.p.Script, p.p.Interpreter))
+	if err := os.Rename(p.script, path); err == nil {
+		return path, nil
+	}
+	// the directories may be on different devices.
+	b, err := ioutil.ReadFile(p.script)
+	if err == nil {
+		err = ioutil.WriteFile(path, b, 0644)
+	}
+	if err != nil {
+		return "", err
+	}
+	os.Remove(p.script)
+	return path, nil
+}
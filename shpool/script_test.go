@@ -0,0 +1,111 @@
+package shpool
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpreter(t *testing.T) {
+	cases := []struct {
+		script, interp string
+		exp            []string
+	}{
+		{"print(1)", "python3 -u", []string{"python3", "-u"}},
+		{"#!/usr/bin/env python3\nprint(1)", "", []string{"/usr/bin/env", "python3"}},
+		{"#!/bin/bash -e \necho", "", []string{"/bin/bash", "-e"}},
+		{"echo hi", "", []string{Shell}},
+	}
+	for _, c := range cases {
+		if got := interpreter(c.script, c.interp); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("interpreter(%q, %q): expected %v, got %v", c.script, c.interp, c.exp, got)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	p := quietPool(2)
+	p.Add(Process{Script: "#!/bin/sh\ntest \"$CPUs\" = 2", CPUs: 2, Prefix: "sh"})
+	p.Add(Process{Script: "exit(3)", Interpreter: "perl", Prefix: "perl"})
+	err := p.Wait()
+	var pe *ProcessError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *ProcessError, got %v", err)
+	}
+	if pe.Prefix != "perl" || pe.ExitCode != 3 || !strings.HasPrefix(pe.Command, "perl ") {
+		t.Fatalf("unexpected error: %+v", pe)
+	}
+	// the script of the failed process is kept in the temp directory.
+	script := strings.Fields(pe.Command)[1]
+	if _, err := os.Stat(script); err != nil {
+		t.Fatalf("expected script to be kept: %s", err)
+	}
+	if filepath.Dir(script) != filepath.Clean(os.TempDir()) {
+		t.Errorf("expected script in %s, got %s", os.TempDir(), script)
+	}
+	os.Remove(script)
+	for _, r := range p.Results() {
+		if r.Prefix == "sh" {
+			if _, err := os.Stat(strings.Fields(r.Command)[1]); err == nil {
+				t.Error("expected script to be removed")
+			}
+		}
+	}
+}
+
+func TestScriptLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := New(2, log.New(ioutil.Discard, "", 0), &Options{Quiet: true, LogDir: dir})
+	p.Add(Process{Script: "exit 1", Prefix: "a"})
+	// the script is removed if the interpreter can't be started.
+	p.Add(Process{Script: "exit 0", Interpreter: "/no/such/shell", Prefix: "b"})
+	p.Wait()
+	if len(p.Results()) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(p.Results()))
+	}
+	for _, r := range p.Results() {
+		script := strings.Fields(r.Command)[1]
+		_, err := os.Stat(script)
+		if r.Prefix == "a" {
+			if exp := filepath.Join(dir, "a.script.sh"); script != exp || err != nil {
+				t.Errorf("expected script kept at %s, got %s (%v)", exp, script, err)
+			}
+		} else if err == nil {
+			t.Errorf("expected script to be removed: %s", script)
+		}
+	}
+}
+
+func TestLongCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("TMPDIR", dir)
+	// the command is run from a temp file in the TMPDIR.
+	p := quietPool(1)
+	p.Add(Process{Command: "test -n \"$(ls $TMPDIR)\" # " + strings.Repeat("x ", 5000)})
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the temp file of a long Command is removed even if it fails.
+	p = quietPool(1)
+	p.Add(Process{Command: "false " + strings.Repeat("x ", 5000)})
+	var pe *ProcessError
+	if err := p.Wait(); !errors.As(err, &pe) {
+		t.Fatalf("expected a *ProcessError, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected temp files to be removed, got %d", len(files))
+	}
+}
@@ -4,15 +4,17 @@ package shpool
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
-	"sort"
+	"os/signal"
+	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/brentp/go-athenaeum/tempclean"
 	"github.com/brentp/go-athenaeum/unsplit"
 	"github.com/fatih/color"
 	isatty "github.com/mattn/go-isatty"
@@ -30,12 +32,124 @@ type Process struct {
 	// Prefix is prepended to the stderr and stdout of this command.
 	// This will be available as the env var 'Prefix' in the running process.
 	Prefix string
+	// Script, if given, is used instead of Command. It is written to a temp
+	// file in os.TempDir() and run with the Interpreter. The file is removed
+	// if the process succeeds. If it fails, the file is kept for debugging
+	// next to its logs in the LogDir or, without a LogDir, in os.TempDir().
+	Script string
+	// Interpreter for the Script, e.g. "python3" or "Rscript". If empty, the
+	// shebang line of the Script is used if present, otherwise the Shell.
+	Interpreter string
+	// Class groups similar processes in the History. If empty, the Prefix is used.
+	Class string
+	// Group is the name of the group (see Options.Groups) that the process
+	// belongs to. Sub-groups are separated by '/' so that a process in
+	// "align/bwa" is limited by both "align/bwa" and "align".
+	Group string
+	// StallTimeout, if given, kills the process with ErrStalled if it writes
+	// nothing to stdout or stderr and uses no CPU time for this long. CPU time
+	// is read from /proc so only output is checked on other systems. It is
+	// checked every StallTimeout/4 but at most every 100ms.
+	StallTimeout time.Duration
+	// Retries is the number of times to run the process again if it fails.
+	// Cancelled processes are not retried.
+	Retries int
+	// RetryIf, if given, is called with the error from a failed attempt (e.g.
+	// ErrStalled or a *PatternError) and returns whether to retry. By default,
+	// all failures are retried.
+	RetryIf func(err error) bool
+	// Nice is the niceness (-20 to 19) to set for the process. Higher values
+	// give the process lower priority for the CPU. 0 leaves it unchanged.
+	Nice int
+	// IOClass and IOPriority (0 to 7; lower is higher priority) set the
+	// I/O scheduling of the process as with ionice(1). Linux only.
+	IOClass    IOClass
+	IOPriority int
+	// Timeout is the maximum time the command may run before it is killed.
+	// Time spent paused (see Pool.Pause) is not counted. Default is no timeout.
+	Timeout time.Duration
+	// SuccessExitCodes are exit codes, in addition to 0, that indicate success.
+	SuccessExitCodes []int
+	// FailOnStdout and FailOnStderr mark the process as failed if any line
+	// written to that stream matches, even if the command exits with 0.
+	// The error is a *PatternError containing the line.
+	FailOnStdout *regexp.Regexp
+	FailOnStderr *regexp.Regexp
+	// SuccessOnStdout and SuccessOnStderr mark the process as successful if
+	// any line written to that stream matches, whatever the exit code. A
+	// matching Fail pattern takes precedence.
+	SuccessOnStdout *regexp.Regexp
+	SuccessOnStderr *regexp.Regexp
+	// Env holds extra environment variables for the command as "KEY=value".
+	// They are added after those of the current process so they take precedence.
+	Env []string
+	// Stdout and Stderr, if given, also receive the output of the command.
+	// They are written from separate goroutines.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Result describes a process that finished or was cancelled.
+type Result struct {
+	// ID of the process as returned by Add.
+	ID      int
+	Prefix  string
+	Command string
+	// ExitCode of the command or -1 if it did not run or did not exit normally.
+	ExitCode int
+	// Err is nil if the process succeeded, otherwise a *ProcessError.
+	Err      error
+	Start    time.Time
+	Duration time.Duration
+	// StdoutLog and StderrLog are the paths to the logs of the process when
+	// Options.LogDir is set.
+	StdoutLog string
+	StderrLog string
 }
 
 type process struct {
 	p   Process
 	c   *exec.Cmd
 	err error
+	// order in which the process was added to the pool.
+	idx int
+	// grouped stdout and stderr; nil unless Options.Group or
+	// Options.KeepOrder is set.
+	out, errOut *group
+
+	cancelled bool
+	timedOut  bool
+	stalled   bool
+	// exited is set once the process has exited and is sent to the poller.
+	exited bool
+	// killed is set by KillAll for a process that has not exited. It is
+	// reaped when it exits.
+	killed bool
+	// number of times the process has been started.
+	attempts   int
+	timer      *time.Timer
+	timerStart time.Time
+	// time remaining before the Timeout.
+	remaining time.Duration
+	// tokens held from Options.Budget while running.
+	tokens []*os.File
+	// check the output against the patterns in the Process.
+	stdoutMatch, stderrMatch *matcher
+	// act records the output of a process with a StallTimeout. stallCPU is
+	// the CPU time last seen in /proc and stallLast the last time that it or
+	// the output changed.
+	act       *activity
+	stallCPU  int64
+	stallLast time.Time
+	// path of the temp file for Process.Script or for a long Command.
+	script string
+	// logs are set when Options.LogDir is given.
+	logs     *plogs
+	started  time.Time
+	duration time.Duration
+	// wall is the wall time from the History used to order the process (-1
+	// if unknown). It is set once when the process is added.
+	wall time.Duration
 }
 
 // wrap log.Logger so we can implement Write
@@ -49,7 +163,10 @@ func (l wlogger) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-// Pool orchestrates the work to be done.
+// Pool orchestrates the work to be done. Each process runs in its own process
+// group so that cancelling it also stops its children. As these groups do not
+// get the signals from the terminal (e.g. Ctrl-C), see Pool.Signal and
+// Options.ForwardSignals.
 type Pool struct {
 	mu               *sync.RWMutex
 	waitingProcesses []*process
@@ -59,25 +176,106 @@ type Pool struct {
 	workerWg         *sync.WaitGroup
 	waiterWg         *sync.WaitGroup
 	start            time.Time
-	err              error
+	errs             Errors
 	logger           wlogger
 	options          *Options
 	ctx              context.Context
 	cancel           context.CancelFunc
+	added            int
+	outputs          outputs
+	// running processes by id.
+	running  map[int]*process
+	paused   bool
+	results  []Result
+	logNames map[string]bool
+	// budgetPolling is set while pollBudget runs.
+	budgetPolling bool
+	// stallWatching is set while watchStalls runs.
+	stallWatching bool
+	// progress is set when Options.Progress is used. progressStop is closed
+	// by Wait to stop showProgress, which then closes progressDone.
+	progress                   *progress
+	progressStop, progressDone chan struct{}
 }
 
 type Options struct {
-	// Stop the entire pool on any error
+	// Stop the entire pool on any error. Cancelled processes are not errors
+	// for this purpose.
 	StopOnError bool
 	// Log outputs will have this prefix
 	LogPrefix string
 	// don't show the running-type of each process.
 	Quiet bool
+	// Group the output (stdout and stderr) of each process and write it as
+	// a single block when the process finishes rather than interleaving the
+	// lines of concurrent processes. The stdout is written as is to Output
+	// and the stderr is written to the logger.
+	Group bool
+	// KeepOrder implies Group and writes the blocks in the order that the
+	// processes were added to the pool (like parallel --keep-order).
+	KeepOrder bool
+	// MaxPending limits the processes with KeepOrder that may run or hold
+	// their output while an earlier process runs. Default is
+	// DefaultMaxPending. It is never less than the CPUs of the pool.
+	MaxPending int
+	// GroupMemory is the number of bytes of output from each process to hold
+	// in memory before spilling to a temp file. Default is DefaultGroupMemory.
+	GroupMemory int
+	// Output is where the grouped output is written with Group or KeepOrder.
+	// Default is os.Stdout.
+	Output io.Writer
+	// Budget, if given, is a CPU budget shared with other pools, possibly in
+	// other programs. Processes only run when there are enough tokens in the budget.
+	Budget *Budget
+	// LogDir, if given, is a directory where the stdout and stderr of each
+	// process are written to <prefix>.out and <prefix>.err. These are gzipped
+	// when the process finishes.
+	LogDir string
+	// LogTail is the number of lines from the end of the stderr log of a
+	// failed process to write to the pool logger. Requires LogDir.
+	LogTail int
+	// LogMaxSize, if given, is the largest size in bytes of a log in LogDir.
+	// A larger log is rotated: it is gzipped to <prefix>.out.1.gz (then .2.gz
+	// and so on) and a new log is started.
+	LogMaxSize int64
+	// LogMaxFiles is the number of rotated files kept for each log. Older
+	// files are removed. Default is to keep all.
+	LogMaxFiles int
+	// DryRun logs the command of each process as it is added instead of
+	// running it. See also Simulate.
+	DryRun bool
+	// Progress shows a continuously updated status area with the running
+	// processes below the log output. This is only used when the log is
+	// written to stderr and stderr is a terminal.
+	Progress bool
+	// Policy determines the order in which waiting processes are started.
+	Policy Policy
+	// History, if given, records the wall time and peak memory of each
+	// successful process. It is required for the LongestFirst Policy and is
+	// saved by Wait.
+	History *History
+	// Groups sets CPU limits for named groups of processes. See Process.Group.
+	Groups map[string]Group
+	// DiscardResults doesn't keep the Result or error of each process, so
+	// Results, Error and Wait report nothing. This is for a long-lived pool
+	// that uses OnFinish instead.
+	DiscardResults bool
+	// ForwardSignals sends each SIGINT and SIGTERM received by the program to
+	// the running processes. The program is not stopped by these signals
+	// (unless it also handles them) so Wait returns once the processes exit.
+	ForwardSignals bool
+	// OnFinish, if given, is called with the Result of each process when it
+	// finishes or is cancelled. It is called in a new goroutine so it may use
+	// the Pool, but calls for different processes may be in any order.
+	OnFinish func(Result)
 }
 
 // New creates a new pool with either the specified logger, or a logger
-// with the given prefix.
+// with the given prefix. It panics if opts.Groups are not possible with cpus.
 func New(cpus int, logger *log.Logger, opts *Options) *Pool {
+	if err := validateGroups(cpus, opts.Groups); err != nil {
+		panic(err)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	p := &Pool{mu: &sync.RWMutex{},
 		waitingProcesses: make([]*process, 0, 16),
@@ -90,6 +288,9 @@ func New(cpus int, logger *log.Logger, opts *Options) *Pool {
 		cancel:           cancel,
 		start:            time.Now(),
 		options:          opts,
+		outputs:          outputs{pending: make(map[int]*process)},
+		running:          make(map[int]*process),
+		logNames:         make(map[string]bool),
 	}
 	if logger == nil {
 		logPrefix := strings.TrimLeft(strings.TrimSpace(opts.LogPrefix)+": ", ": ")
@@ -97,6 +298,15 @@ func New(cpus int, logger *log.Logger, opts *Options) *Pool {
 	} else {
 		p.logger = wlogger{&sync.Mutex{}, logger}
 	}
+	if opts.Progress && p.logger.Writer() == os.Stderr && isatty.IsTerminal(os.Stderr.Fd()) {
+		p.progress = &progress{w: os.Stderr, width: func() int { return termWidth(os.Stderr.Fd()) }}
+		p.logger = wlogger{&sync.Mutex{}, log.New(p.progress, p.logger.Prefix(), p.logger.Flags())}
+	}
+	if opts.ForwardSignals {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		go p.forwardSignals(c)
+	}
 	go p.poll()
 	return p
 }
@@ -152,155 +362,523 @@ var red = color.New(color.BgRed).Add(color.Bold).SprintfFunc()
 var yellow = color.New(color.BgYellow).Add(color.Bold).SprintfFunc()
 
 func (p *process) submit(pool *Pool) error {
-	var t *os.File
-	pool.workerWg.Add(1)
-	if len(p.p.Command) < 8192 {
+	script, interp := p.p.Script, p.p.Interpreter
+	if script == "" && len(p.p.Command) >= 8192 {
+		// use a temp file for large commands.
+		script, interp = p.p.Command, Shell
+	}
+	if script == "" {
 		p.c = exec.CommandContext(pool.ctx, Shell, "-c", p.p.Command)
 	} else {
-		// use a temp file for large files.
-		var err error
-		t, err = tempclean.TempFile(p.p.Prefix, ".sh")
+		args, err := p.writeScript(script, interp)
 		if err != nil {
-			return errors.Wrap(err, "[shpool] error creating temp file")
-		}
-		if _, err := t.Write([]byte(p.p.Command)); err != nil {
-			return errors.Wrap(err, "[shpool] error writing to temp file")
-		}
-		if err := t.Close(); err != nil {
-			return errors.Wrap(err, "[shpool] error closing to temp file")
+			return err
 		}
-		p.c = exec.Command(Shell, "-c", Shell+" "+t.Name())
+		p.c = exec.CommandContext(pool.ctx, args[0], args[1:]...)
 	}
 	p.c.Env = os.Environ()
 	p.c.Env = append(p.c.Env, fmt.Sprintf("CPUs=%d", p.p.CPUs))
-	p.c.Env = append(p.c.Env, fmt.Sprintf("Prefix='%d'", p.p.Prefix))
-	p.c.Stderr = &prefixer{w: pool.logger, prefix: red("[E]" + p.p.Prefix)}
-	p.c.Stdout = &prefixer{w: pool.logger, prefix: yellow("[O]" + p.p.Prefix)}
-	if t != nil {
-		defer os.Remove(t.Name())
-	}
-	// todo copy gargs kill setup.
-	err := p.c.Start()
+	p.c.Env = append(p.c.Env, "Prefix="+p.p.Prefix)
+	p.c.Env = append(p.c.Env, p.p.Env...)
+	if pool.options.Group || pool.options.KeepOrder {
+		w, out := pool.groupLoggers(p)
+		p.c.Stderr = &prefixer{w: w, prefix: red("[E]" + p.p.Prefix)}
+		p.c.Stdout = out
+	} else {
+		p.c.Stderr = &prefixer{w: pool.logger, prefix: red("[E]" + p.p.Prefix)}
+		p.c.Stdout = &prefixer{w: pool.logger, prefix: yellow("[O]" + p.p.Prefix)}
+	}
+	if pool.options.LogDir != "" {
+		if err := pool.openLogs(p); err != nil {
+			return err
+		}
+		p.c.Stderr = io.MultiWriter(p.c.Stderr, p.logs.err)
+		p.c.Stdout = io.MultiWriter(p.c.Stdout, p.logs.out)
+	}
+	if p.p.Stdout != nil {
+		p.c.Stdout = io.MultiWriter(p.c.Stdout, p.p.Stdout)
+	}
+	if p.p.Stderr != nil {
+		p.c.Stderr = io.MultiWriter(p.c.Stderr, p.p.Stderr)
+	}
+	p.act = nil
+	if p.p.StallTimeout > 0 {
+		p.act = &activity{}
+		p.c.Stdout = io.MultiWriter(p.c.Stdout, p.act)
+		p.c.Stderr = io.MultiWriter(p.c.Stderr, p.act)
+	}
+	p.stdoutMatch, p.stderrMatch = p.matchers()
+	if p.stdoutMatch != nil {
+		p.c.Stdout = io.MultiWriter(p.c.Stdout, p.stdoutMatch)
+	}
+	if p.stderrMatch != nil {
+		p.c.Stderr = io.MultiWriter(p.c.Stderr, p.stderrMatch)
+	}
+	// run in a new process group so that signals reach all children.
+	p.c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := p.c.Start(); err != nil {
+		if p.logs != nil {
+			p.logs.outPath, p.logs.errPath, _, _ = p.logs.close(0)
+		}
+		if p.script != "" {
+			os.Remove(p.script)
+		}
+		return errors.Wrap(err, "[shpool] error starting command")
+	}
+	p.started = time.Now()
+	if err := p.setPriorities(); err != nil {
+		pool.logger.Printf("%s for process: %s", err, p.p.Prefix)
+	}
+	if p.attempts == 0 {
+		pool.workerWg.Add(1)
+	}
+	p.attempts++
+	p.startTimer(pool)
+	if p.act != nil {
+		p.stallCPU, p.stallLast = -1, p.started
+		if !pool.stallWatching {
+			pool.stallWatching = true
+			go pool.watchStalls()
+		}
+	}
 	go func() {
 		// wait in the background and notify the poller.
-		p.err = p.c.Wait()
-		if e := pool.ctx.Err(); e == nil {
-			pool.poller <- p
+		err := p.c.Wait()
+		p.duration = time.Since(p.started)
+		pool.mu.Lock()
+		p.stopTimer()
+		if p.cancelled {
+			err = ErrCancelled
+		} else if p.timedOut {
+			err = ErrTimeout
+		} else if p.stalled {
+			err = ErrStalled
+		} else {
+			err = p.applyRules(err)
+		}
+		pool.mu.Unlock()
+		if p.logs != nil {
+			pool.closeLogs(p, err)
+		}
+		pool.removeScript(p, err)
+		p.err = err
+		pool.mu.Lock()
+		killed := p.killed
+		p.exited = true
+		pool.mu.Unlock()
+		if killed {
+			pool.reap(p)
+			return
+		}
+		select {
+		case pool.poller <- p:
+		case <-pool.ctx.Done():
 		}
 	}()
-	return err
+	return nil
 }
 
-func (pool *Pool) checkErr(p *process) {
+// done records the result and the error (if any) for p.
+// must be called in a lock
+func (pool *Pool) done(p *process) {
+	r := Result{ID: p.idx, Prefix: p.p.Prefix, Command: p.command(), ExitCode: -1,
+		Start: p.started, Duration: p.duration}
+	if p.logs != nil {
+		r.StdoutLog, r.StderrLog = p.logs.outPath, p.logs.errPath
+	}
+	if p.c != nil && p.c.ProcessState != nil {
+		r.ExitCode = p.c.ProcessState.ExitCode()
+	}
+	if h := pool.options.History; h != nil {
+		h.record(p)
+	}
+	defer func() { pool.finish(r) }()
 	if p.err == nil {
 		return
 	}
-	pool.err = p.err
+	e := newProcessError(p)
+	r.Err = e
+	pool.addError(e)
+
+	pool.logger.Printf("error running command: %s -> %s", p.command(), p.err)
+	if pool.options.StopOnError && p.err != ErrCancelled {
+		pool.killAll()
+	}
+}
+
+// recordKilled records the error and Result of a process killed by KillAll.
+// must be called in a lock
+func (pool *Pool) recordKilled(p *process) {
+	p.err = ErrCancelled
+	e := newProcessError(p)
+	pool.addError(e)
+	r := Result{ID: p.idx, Prefix: p.p.Prefix, Command: p.command(), ExitCode: e.ExitCode,
+		Err: e, Start: p.started, Duration: p.duration}
+	if p.logs != nil {
+		r.StdoutLog, r.StderrLog = p.logs.outPath, p.logs.errPath
+	}
+	pool.finish(r)
+}
 
-	pool.logger.Printf("error running command: %s -> %s", p.p.Command, p.err)
-	if pool.options.StopOnError {
-		pool.KillAll()
-		close(pool.poller)
+// addError records the error of a process for Wait.
+// must be called in a lock
+func (pool *Pool) addError(e *ProcessError) {
+	if !pool.options.DiscardResults {
+		pool.errs = append(pool.errs, e)
+	}
+}
+
+// finish records the result of a process.
+// must be called in a lock
+func (pool *Pool) finish(r Result) {
+	if !pool.options.DiscardResults {
+		pool.results = append(pool.results, r)
+	}
+	if f := pool.options.OnFinish; f != nil {
+		go f(r)
+	}
+}
+
+// closeLogs closes the logs of a finished process and writes the tail of the
+// stderr log to the pool logger if the process failed.
+func (pool *Pool) closeLogs(p *process, err error) {
+	n := 0
+	if err != nil {
+		n = pool.options.LogTail
+	}
+	outPath, errPath, tail, lerr := p.logs.close(n)
+	pool.mu.Lock()
+	p.logs.outPath, p.logs.errPath = outPath, errPath
+	pool.mu.Unlock()
+	if lerr != nil {
+		pool.logger.Printf("error closing logs for process: %s -> %s", p.p.Prefix, lerr)
+	}
+	if len(tail) != 0 {
+		pool.logger.Printf("last %d lines of stderr for failed process: %s (%s):\n%s", n, p.p.Prefix, errPath, tail)
 	}
 }
 
 func (pool *Pool) poll() {
-	for p := range pool.poller {
+	for {
+		var p *process
+		select {
+		case p = <-pool.poller:
+		case <-pool.ctx.Done():
+			return
+		}
 		if !pool.options.Quiet {
 			ut := p.c.ProcessState.UserTime()
 			st := p.c.ProcessState.SystemTime()
-			cmd := p.p.Command
+			cmd := p.command()
 			if len(cmd) > 100 {
 				cmd = cmd[0:100]
 			}
 			pool.logger.Printf("finished process: %s (%s) in user-time:%s system-time:%s", p.p.Prefix, cmd, ut, st)
 		}
 		pool.mu.Lock()
-
-		select {
-		case <-pool.ctx.Done():
-			break
-		default:
+		if _, ok := pool.running[p.idx]; !ok {
+			// already handled by KillAll.
+			pool.mu.Unlock()
+			continue
 		}
 
 		pool.runningCpus -= p.p.CPUs
-		pool.checkErr(p)
-		pool.workerWg.Done()
+		release(p.tokens)
+		delete(pool.running, p.idx)
+		if !pool.retry(p) {
+			pool.done(p)
+			pool.emit(p)
+			pool.workerWg.Done()
+		}
 
 		pool.sendWaiting()
 		pool.mu.Unlock()
 	}
 }
 
+// retry queues p to run again if it failed and has retries left.
+// must be called in a lock
+func (pool *Pool) retry(p *process) bool {
+	if p.err == nil || p.cancelled || p.attempts > p.p.Retries || pool.ctx.Err() != nil {
+		return false
+	}
+	if p.p.RetryIf != nil && !p.p.RetryIf(p.err) {
+		return false
+	}
+	pool.logger.Printf("retrying process: %s (attempt %d of %d) after error: %s", p.p.Prefix, p.attempts+1, p.p.Retries+1, p.err)
+	p.err = nil
+	p.timedOut, p.stalled, p.exited = false, false, false
+	p.timer, p.remaining = nil, 0
+	p.tokens, p.logs, p.script = nil, nil, ""
+	// retries go first. p is still counted in the workerWg.
+	pool.enqueue(p, true)
+	return true
+}
+
+// forget a waiting process that will not be run.
+// must be called in a lock
+func (pool *Pool) forget(p *process) {
+	if p.attempts == 0 {
+		pool.waiterWg.Done()
+	} else {
+		// a retry is counted in the workerWg.
+		pool.workerWg.Done()
+	}
+}
+
 // try to run more processes.
 // must be called in a lock
 func (pool *Pool) sendWaiting() {
 
-	if len(pool.waitingProcesses) == 0 {
+	if len(pool.waitingProcesses) == 0 || pool.paused {
 		return
 	}
 
-	available := pool.totalCpus - pool.runningCpus
-	var used []int
-
-	for i, w := range pool.waitingProcesses {
-		if w.p.CPUs > available {
-			continue
-		}
-		available -= w.p.CPUs
-		used = append(used, i)
-
+	var ok func(*process) bool
+	if pool.options.KeepOrder {
+		// don't run too far ahead of the output that has been written.
+		pool.outputs.mu.Lock()
+		last := pool.outputs.next + pool.maxPending()
+		pool.outputs.mu.Unlock()
+		ok = func(w *process) bool { return w.idx < last }
 	}
-	if len(used) != 0 {
-		sort.Slice(used, func(i, j int) bool { return used[i] > used[j] })
-		for _, i := range used {
-			proc := pool.waitingProcesses[i]
-			if err := proc.submit(pool); err != nil {
-				pool.checkErr(proc)
+	if b := pool.options.Budget; b != nil {
+		inOrder := ok
+		ok = func(w *process) bool {
+			if inOrder != nil && !inOrder(w) {
+				return false
 			}
+			w.tokens = b.acquire(w.p.CPUs)
+			return w.tokens != nil
+		}
+	}
+	var gs *groupState
+	if len(pool.options.Groups) != 0 {
+		running := make([]*process, 0, len(pool.running))
+		for _, p := range pool.running {
+			running = append(running, p)
+		}
+		gs = newGroupState(pool.options.Groups, running, pool.waitingProcesses)
+	}
+	used := pick(pool.waitingProcesses, pool.totalCpus-pool.runningCpus, gs, ok)
+	procs := make([]*process, len(used))
+	for i, j := range used {
+		procs[i] = pool.waitingProcesses[j]
+	}
+	pool.waitingProcesses = remove(pool.waitingProcesses, used)
+	if pool.options.Budget != nil && len(pool.waitingProcesses) != 0 && !pool.budgetPolling {
+		pool.budgetPolling = true
+		go pool.pollBudget()
+	}
+
+	failed := false
+	for _, proc := range procs {
+		if pool.ctx.Err() != nil {
+			// the pool was killed by an earlier process in this loop.
+			release(proc.tokens)
+			pool.forget(proc)
+		} else if err := proc.submit(pool); err != nil {
+			release(proc.tokens)
+			proc.err = err
+			pool.done(proc)
+			pool.emit(proc)
+			pool.forget(proc)
+			failed = true
+		} else {
 			pool.runningCpus += proc.p.CPUs
-			pool.waiterWg.Done()
-			pool.waitingProcesses = append(pool.waitingProcesses[:i], pool.waitingProcesses[i+1:]...)
+			pool.running[proc.idx] = proc
+			if proc.attempts == 1 {
+				// this must come after submit adds to the workerWg.
+				pool.waiterWg.Done()
+			}
 		}
 	}
+	if failed && pool.options.KeepOrder {
+		// the output of the failed processes may let others start.
+		pool.sendWaiting()
+	}
 }
 
-// Wait until all processes are finished.
+// Wait until all processes are finished. If any failed, the error is of type
+// Errors and contains a *ProcessError for each failed process.
 func (pool *Pool) Wait() error {
 	pool.waiterWg.Wait()
 	pool.workerWg.Wait()
-	return pool.err
+	pool.flushOutputs()
+	if pool.progress != nil {
+		pool.stopProgress()
+		pool.progress.update(pool.status(time.Now()))
+	}
+	if h := pool.options.History; h != nil {
+		if err := h.Save(); err != nil {
+			pool.logger.Printf("%s", err)
+		}
+	}
+	return pool.Error()
 }
 
-// Add a process to the pool.
-func (pool *Pool) Add(p Process) {
-	if p.CPUs > pool.totalCpus {
-		panic("shpool: cant handle a process with more cpus than the pool")
+// Add a process to the pool. The returned id can be used to Cancel the process.
+// Add panics if the process is not valid (see Process.Validate) or needs more
+// CPUs than the pool.
+func (pool *Pool) Add(p Process) int {
+	if err := pool.check(p); err != nil {
+		panic(err)
 	}
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 	if p.CPUs == 0 {
 		p.CPUs = 1
 	}
-	pr := process{p: p}
+	pr := process{p: p, idx: pool.added}
+	pool.added++
+	if pool.options.DryRun {
+		pool.logger.Printf("dry-run: %s: %s", p.Prefix, pr.command())
+		return pr.idx
+	}
 	pool.waiterWg.Add(1)
-	pool.waitingProcesses = append(pool.waitingProcesses, &pr)
+	if h := pool.options.History; h != nil && pool.options.Policy == LongestFirst {
+		pr.wall = h.wall(&pr)
+	}
+	pool.enqueue(&pr, false)
+	if pool.progress != nil && pool.progressStop == nil {
+		pool.progressStop, pool.progressDone = make(chan struct{}), make(chan struct{})
+		go pool.showProgress(pool.progressStop, pool.progressDone)
+	}
 	pool.sendWaiting()
+	return pr.idx
 }
 
-// Error returns any error in the pool
+// check returns an error if p can never be run by the pool.
+func (pool *Pool) check(p Process) error {
+	if p.CPUs > pool.totalCpus {
+		return fmt.Errorf("shpool: cant handle a process with more cpus than the pool")
+	}
+	if b := pool.options.Budget; b != nil && p.CPUs > b.cpus {
+		return fmt.Errorf("shpool: cant handle a process with more cpus than the budget")
+	}
+	if max := groupMax(p, pool.options.Groups); max > 0 && p.CPUs > max {
+		return fmt.Errorf("shpool: cant handle a process with more cpus than its group")
+	}
+	return p.Validate()
+}
+
+// Error returns any error in the pool so far as Errors (or nil).
 func (pool *Pool) Error() error {
-	return pool.err
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if len(pool.errs) == 0 {
+		return nil
+	}
+	return append(Errors(nil), pool.errs...)
+}
+
+// Results returns the results of the processes that have finished so far, in
+// the order that they finished.
+func (pool *Pool) Results() []Result {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return append([]Result(nil), pool.results...)
+}
+
+// State of a process in a Pool.
+type State int
+
+const (
+	// Unknown is the State of an id that was not returned by Add.
+	Unknown State = iota
+	Waiting
+	Running
+	// Finished processes have a Result.
+	Finished
+)
+
+func (s State) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Running:
+		return "running"
+	case Finished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+// State returns the State of the process with the given id (as returned by Add).
+// With DiscardResults, a process that is not waiting or running is Finished.
+func (pool *Pool) State(id int) State {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if _, ok := pool.running[id]; ok {
+		return Running
+	}
+	for _, p := range pool.waitingProcesses {
+		if p.idx == id {
+			return Waiting
+		}
+	}
+	if pool.options.DiscardResults {
+		if id >= 0 && id < pool.added {
+			return Finished
+		}
+		return Unknown
+	}
+	for _, r := range pool.results {
+		if r.ID == id {
+			return Finished
+		}
+	}
+	return Unknown
 }
 
-// KillAll processes in the pool.
+// KillAll processes in the pool. Running processes are reported with ErrCancelled.
+// Wait returns once they have exited and their grouped output is written.
 func (pool *Pool) KillAll() {
 	pool.mu.Lock()
-	pool.waitingProcesses = pool.waitingProcesses[:0]
+	pool.killAll()
+	pool.mu.Unlock()
+}
+
+// must be called in a lock
+func (pool *Pool) killAll() {
+	if pool.ctx.Err() != nil {
+		return
+	}
 	pool.cancel()
+	for _, p := range pool.waitingProcesses {
+		p.err = ErrNotStarted
+		e := newProcessError(p)
+		pool.addError(e)
+		pool.finish(Result{ID: p.idx, Prefix: p.p.Prefix, Command: p.command(), ExitCode: -1, Err: e})
+		pool.forget(p)
+	}
+	pool.waitingProcesses = pool.waitingProcesses[:0]
+	for id, p := range pool.running {
+		p.cancelled = true
+		delete(pool.running, id)
+		if p.exited {
+			// its logs are closed and its output is complete.
+			pool.recordKilled(p)
+			release(p.tokens)
+			pool.emit(p)
+			pool.workerWg.Done()
+		} else {
+			p.killed = true
+			p.signal(syscall.SIGKILL)
+		}
+	}
 	pool.runningCpus = 0
-	close(pool.poller)
-	pool.waiterWg = &sync.WaitGroup{}
-	pool.workerWg = &sync.WaitGroup{}
+}
+
+// reap a process killed by KillAll once it has exited. Its Result is only
+// recorded now so that it has the paths of the compressed logs, its budget
+// tokens are only released now so that other pools don't start processes on
+// its CPUs and Wait returns after this so that its (grouped) output is written.
+func (pool *Pool) reap(p *process) {
+	pool.mu.Lock()
+	pool.recordKilled(p)
 	pool.mu.Unlock()
+	release(p.tokens)
+	pool.emit(p)
+	pool.workerWg.Done()
 }
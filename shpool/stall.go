@@ -0,0 +1,121 @@
+package shpool
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrStalled is the error for a process that wrote no output and used no CPU
+// time for its StallTimeout.
+var ErrStalled = errors.New("shpool: process stalled")
+
+// activity is an io.Writer that records the time of the last write.
+type activity struct {
+	last int64
+}
+
+func (a *activity) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	return len(b), nil
+}
+
+// groupCPUs returns the total CPU time in clock ticks used by the processes
+// in each process group (and their waited-for children) according to /proc.
+// It returns nil if /proc is not available.
+func groupCPUs() map[int]int64 {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	cpus := make(map[int]int64)
+	for _, d := range dirs {
+		if d.Name()[0] < '0' || d.Name()[0] > '9' {
+			continue
+		}
+		b, err := ioutil.ReadFile("/proc/" + d.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// the command (2nd field) may contain spaces so start after it.
+		i := strings.LastIndexByte(string(b), ')')
+		if i == -1 {
+			continue
+		}
+		fields := strings.Fields(string(b[i+1:]))
+		// fields[0] is the state (3rd field) so pgrp is 5th and utime..cstime are 14th..17th.
+		if len(fields) < 15 {
+			continue
+		}
+		pgid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		for _, f := range fields[11:15] {
+			v, _ := strconv.ParseInt(f, 10, 64)
+			cpus[pgid] += v
+		}
+	}
+	return cpus
+}
+
+// stallInterval returns the interval at which to check for a StallTimeout.
+func stallInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 4
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	} else if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+// watchStalls kills running processes that write no output and use no CPU
+// time for their StallTimeout. /proc is read once per check for all of them.
+// It returns when no running process has a StallTimeout.
+func (pool *Pool) watchStalls() {
+	for {
+		pool.mu.Lock()
+		var interval time.Duration
+		for _, p := range pool.running {
+			if p.act != nil && !p.exited && (interval == 0 || stallInterval(p.p.StallTimeout) < interval) {
+				interval = stallInterval(p.p.StallTimeout)
+			}
+		}
+		if interval == 0 {
+			pool.stallWatching = false
+			pool.mu.Unlock()
+			return
+		}
+		pool.mu.Unlock()
+
+		time.Sleep(interval)
+		cpus := groupCPUs()
+		now := time.Now()
+		pool.mu.Lock()
+		for _, p := range pool.running {
+			if p.act == nil || p.exited || p.cancelled || p.timedOut || p.stalled {
+				continue
+			}
+			if c, ok := cpus[p.c.Process.Pid]; ok && c != p.stallCPU {
+				p.stallCPU, p.stallLast = c, now
+			}
+			if out := time.Unix(0, atomic.LoadInt64(&p.act.last)); out.After(p.stallLast) {
+				p.stallLast = out
+			}
+			if pool.paused {
+				// stopped processes don't use CPU, so don't count paused time.
+				p.stallLast = now
+			} else if now.Sub(p.stallLast) > p.p.StallTimeout {
+				p.stalled = true
+				pool.logger.Printf("stalled for %s, killing process: %s", p.p.StallTimeout, p.p.Prefix)
+				p.signal(syscall.SIGKILL)
+			}
+		}
+		pool.mu.Unlock()
+	}
+}
@@ -0,0 +1,82 @@
+package shpool
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStall(t *testing.T) {
+	p := quietPool(3)
+	p.Add(Process{Command: "sleep 10", Prefix: "stalled", StallTimeout: 300 * time.Millisecond})
+	p.Add(Process{Command: "for i in 1 2 3 4 5 6; do echo $i; sleep 0.1; done", Prefix: "output", StallTimeout: 300 * time.Millisecond})
+	p.Add(Process{Command: "while :; do :; done", Prefix: "busy", StallTimeout: 200 * time.Millisecond, Timeout: time.Second})
+	start := time.Now()
+	err := p.Wait()
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected stalled process to be killed")
+	}
+	var es Errors
+	if !errors.As(err, &es) || len(es) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	for _, e := range es {
+		switch e.Prefix {
+		case "stalled":
+			if !errors.Is(e, ErrStalled) {
+				t.Errorf("expected ErrStalled, got: %v", e)
+			}
+		case "busy":
+			if !errors.Is(e, ErrTimeout) {
+				t.Errorf("expected busy process to time out rather than stall, got: %v", e)
+			}
+		default:
+			t.Errorf("unexpected error: %v", e)
+		}
+	}
+}
+
+func TestGroupCPUs(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	if _, ok := groupCPUs()[syscall.Getpgrp()]; !ok {
+		t.Fatal("expected cpu time from /proc")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shpool-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	p := quietPool(1)
+	// fails the first time only.
+	p.Add(Process{Command: "test -f " + marker + " || { touch " + marker + "; exit 1; }", Retries: 2})
+	if err := p.Wait(); err != nil {
+		t.Fatalf("expected retry to succeed, got: %v", err)
+	}
+
+	p = quietPool(1)
+	p.Add(Process{Command: "sleep 10", StallTimeout: 100 * time.Millisecond, Retries: 3,
+		RetryIf: func(err error) bool { return !errors.Is(err, ErrStalled) }})
+	p.Add(Process{Command: "exit 1", Retries: 2})
+	err = p.Wait()
+	var es Errors
+	if !errors.As(err, &es) || len(es) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", err)
+	}
+	if es[0].Attempts != 1 || !errors.Is(es[0], ErrStalled) {
+		t.Errorf("expected stalled process not to be retried: %+v", es[0])
+	}
+	if es[1].Attempts != 3 {
+		t.Errorf("expected 3 attempts, got: %+v", es[1])
+	}
+}
@@ -0,0 +1,151 @@
+package shpool
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Table holds the rows of arguments used to expand a template with AddTemplate.
+type Table struct {
+	// Header is optional. If given, it names the columns so that they can be
+	// used as {name} placeholders in the template.
+	Header []string
+	// Rows of arguments. Each row produces one Process.
+	Rows [][]string
+}
+
+// placeholders look like {1}, {name}, {basename} or {2:noext}. A placeholder
+// preceded by '$' is a shell variable (${name}) and is left alone.
+var placeholder = regexp.MustCompile(`\$?\{(\d+|[A-Za-z_][A-Za-z0-9_]*)?(?::(basename|noext|dirname))?\}`)
+
+// modifiers that may be used alone (applied to the first column) or after a
+// column as {1:basename}.
+var modifiers = map[string]func(string) string{
+	"basename": filepath.Base,
+	"noext":    noext,
+	"dirname":  filepath.Dir,
+}
+
+func noext(s string) string {
+	return strings.TrimSuffix(s, filepath.Ext(s))
+}
+
+// safe characters do not need to be quoted for the shell.
+var unsafe = regexp.MustCompile(`[^\w@%+=:,./-]`)
+
+// Quote returns s quoted so that the shell will see it as a single word.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if !unsafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// expand fills the placeholders in tmpl with values from row. {} is replaced
+// with all values in the row. {N} is replaced with the Nth (1-based) column and
+// {name} with the column of that name in header. {basename}, {noext} and
+// {dirname} apply to the first column, or to any column as {N:basename}.
+// Unknown names are left as-is so that, for example, awk '{print}' is unchanged.
+// If quote is true, the substituted values are quoted for the shell.
+func expand(tmpl string, header []string, row []string, quote bool) (string, error) {
+	var err error
+	q := func(s string) string {
+		if quote {
+			return Quote(s)
+		}
+		return s
+	}
+	result := placeholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if m[0] == '$' {
+			return m
+		}
+		sub := placeholder.FindStringSubmatch(m)
+		name, mod := sub[1], sub[2]
+		if name == "" && mod == "" {
+			vals := make([]string, len(row))
+			for i, v := range row {
+				vals[i] = q(v)
+			}
+			return strings.Join(vals, " ")
+		}
+		if _, ok := modifiers[name]; ok && mod == "" {
+			name, mod = "1", name
+		} else if name == "" {
+			name = "1"
+		}
+		col := -1
+		if n, e := strconv.Atoi(name); e == nil {
+			if n < 1 || n > len(row) {
+				err = fmt.Errorf("shpool: placeholder {%s} out of range for row with %d values", name, len(row))
+				return m
+			}
+			col = n - 1
+		} else {
+			for i, h := range header {
+				if h == name {
+					col = i
+					break
+				}
+			}
+			if col == -1 {
+				return m
+			}
+			if col >= len(row) {
+				err = fmt.Errorf("shpool: placeholder {%s} out of range for row with %d values", name, len(row))
+				return m
+			}
+		}
+		v := row[col]
+		if mod != "" {
+			v = modifiers[mod](v)
+		}
+		return q(v)
+	})
+	return result, err
+}
+
+// AddTemplate adds one process to the pool for each row in the table. The
+// Command and Prefix of tmpl may contain placeholders (see below) which are
+// filled from the row; values in the Command are quoted for the shell. If tmpl
+// has no Prefix, the (1-based) index of the row and its values are used as the
+// prefix, e.g. "2:a b", so that prefixes are unique.
+//
+// The placeholders are similar to those in gargs and GNU parallel:
+//
+//	{}          all values in the row separated by spaces.
+//	{1}, {2}    the value in the 1st, 2nd column.
+//	{name}      the value in the column with that name in the Header.
+//	{basename}  the base name of the first column (also {dirname}, {noext})
+//	{2:noext}   the 2nd column without its extension (also {name:noext})
+//
+// If any row fails to expand or could never be run by the pool, an error is
+// returned and no processes are added.
+func (pool *Pool) AddTemplate(tmpl Process, t Table) error {
+	procs := make([]Process, 0, len(t.Rows))
+	for i, row := range t.Rows {
+		p := tmpl
+		var err error
+		if p.Command, err = expand(tmpl.Command, t.Header, row, true); err != nil {
+			return fmt.Errorf("%s (row %d)", err, i+1)
+		}
+		if tmpl.Prefix == "" {
+			p.Prefix = strconv.Itoa(i+1) + ":" + strings.Join(row, " ")
+		} else if p.Prefix, err = expand(tmpl.Prefix, t.Header, row, false); err != nil {
+			return fmt.Errorf("%s (row %d)", err, i+1)
+		}
+		if err := pool.check(p); err != nil {
+			return fmt.Errorf("%s (row %d)", err, i+1)
+		}
+		procs = append(procs, p)
+	}
+	for _, p := range procs {
+		pool.Add(p)
+	}
+	return nil
+}
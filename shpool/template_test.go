@@ -0,0 +1,94 @@
+package shpool
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	cases := [][2]string{
+		{"abc.txt", "abc.txt"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it'"'"'s'`},
+		{"$(rm -rf /)", "'$(rm -rf /)'"},
+	}
+	for _, c := range cases {
+		if got := Quote(c[0]); got != c[1] {
+			t.Errorf("Quote(%q): expected %s, got %s", c[0], c[1], got)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	header := []string{"sample", "bam"}
+	row := []string{"s 1", "/data/x.sorted.bam"}
+	cases := [][2]string{
+		{"echo {1} {2}", "echo 's 1' /data/x.sorted.bam"},
+		{"echo {sample}", "echo 's 1'"},
+		{"echo {}", "echo 's 1' /data/x.sorted.bam"},
+		{"echo {2:basename}", "echo x.sorted.bam"},
+		{"echo {bam:noext}.cram", "echo /data/x.sorted.cram"},
+		{"echo {bam:dirname}", "echo /data"},
+		{"echo {1}{2}", "echo 's 1'/data/x.sorted.bam"},
+		{"echo ${sample} {unknown}", "echo ${sample} {unknown}"},
+		{"awk '{print $1}' {2}", "awk '{print $1}' /data/x.sorted.bam"},
+	}
+	for _, c := range cases {
+		got, err := expand(c[0], header, row, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c[1] {
+			t.Errorf("expand(%q): expected %s, got %s", c[0], c[1], got)
+		}
+	}
+	got, err := expand("{basename}", nil, []string{"/a/b.txt"}, false)
+	if err != nil || got != "b.txt" {
+		t.Errorf("expected b.txt, got %s (%v)", got, err)
+	}
+	if _, err := expand("echo {3}", header, row, true); err == nil {
+		t.Error("expected error for out of range placeholder")
+	}
+}
+
+func TestAddTemplate(t *testing.T) {
+	p := New(2, log.New(os.Stderr, "", 0), &Options{Quiet: true})
+	err := p.AddTemplate(Process{Command: "test {1} = {2}"}, Table{Rows: [][]string{{"a", "a"}, {"b c", "b c"}, {"a", "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the automatic prefixes are unique even for repeated rows.
+	prefixes := map[string]bool{}
+	for _, r := range p.Results() {
+		prefixes[r.Prefix] = true
+	}
+	if !prefixes["1:a a"] || !prefixes["2:b c b c"] || !prefixes["3:a a"] {
+		t.Errorf("unexpected prefixes: %v", prefixes)
+	}
+	if err := p.AddTemplate(Process{Command: "echo {2}"}, Table{Rows: [][]string{{"a"}}}); err == nil {
+		t.Fatal("expected error for missing column")
+	}
+
+	dir, err := ioutil.TempDir("", "shpool-budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := NewBudget(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = New(4, log.New(os.Stderr, "", 0), &Options{Quiet: true, Budget: b})
+	if err := p.AddTemplate(Process{Command: "true", CPUs: 2}, Table{Rows: [][]string{{"a"}, {"b"}}}); err == nil {
+		t.Fatal("expected error for a process with more cpus than the budget")
+	}
+	if err := p.Wait(); err != nil || len(p.Results()) != 0 {
+		t.Errorf("expected no processes to be added, got %d (%v)", len(p.Results()), err)
+	}
+}